@@ -0,0 +1,21 @@
+package main
+
+import "testing"
+
+func TestAppendText(t *testing.T) {
+	testdata := []struct {
+		Body, Text, Separator string
+		Want                  string
+	}{
+		{"", "first", "", "first\n"},
+		{"line1\n", "line2", "", "line1\nline2\n"},
+		{"line1", "line2\n", "", "line1\nline2\n"},
+		{"line1\r\n", "a\nb", "---", "line1\r\n---\r\na\r\nb\r\n"},
+	}
+
+	for _, d := range testdata {
+		if got := appendText(d.Body, d.Text, d.Separator); got != d.Want {
+			t.Errorf("appendText(%q, %q, %q) = %q, want %q", d.Body, d.Text, d.Separator, got, d.Want)
+		}
+	}
+}
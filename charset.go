@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/mail"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/japanese"
+	"golang.org/x/text/transform"
+)
+
+// localEncodings are encodings of local files other than UTF-8.
+var localEncodings = map[string]encoding.Encoding{
+	"shift_jis":   japanese.ShiftJIS,
+	"euc-jp":      japanese.EUCJP,
+	"iso-2022-jp": japanese.ISO2022JP,
+}
+
+// normalizeEncodingName returns the canonical name of an encoding, "" for UTF-8.
+func normalizeEncodingName(name string) (string, error) {
+	n := strings.Replace(strings.ToLower(strings.TrimSpace(name)), "_", "-", -1)
+	switch n {
+	case "", "utf-8", "utf8", "utf-8-sig":
+		return "", nil
+	case "shift-jis", "sjis", "cp932", "windows-31j", "ms932", "x-sjis":
+		return "shift_jis", nil
+	case "euc-jp", "eucjp", "x-euc-jp":
+		return "euc-jp", nil
+	case "iso-2022-jp", "jis", "csiso2022jp":
+		return "iso-2022-jp", nil
+	}
+	return "", fmt.Errorf("unsupported encoding %q (utf-8, shift_jis, euc-jp, iso-2022-jp)", name)
+}
+
+// toUTF8 converts data of a local file into UTF-8.
+//
+// If enc is "" (UTF-8) but data is not valid UTF-8, the encoding is detected among Japanese ones.
+// It returns the encoding actually used ("" for UTF-8).
+func toUTF8(data []byte, enc string) ([]byte, string, error) {
+	if bytes.HasPrefix(data, utf8BOM) {
+		// obviously UTF-8 whatever enc is
+		return data, "", nil
+	}
+
+	if enc == "" {
+		if utf8.Valid(data) && !isISO2022JP(data) {
+			return data, "", nil
+		}
+		enc = detectJapaneseEncoding(data)
+		if enc == "" {
+			return data, "", nil
+		}
+	}
+
+	e, found := localEncodings[enc]
+	if !found {
+		return nil, "", fmt.Errorf("unsupported encoding %q", enc)
+	}
+	decoded, _, err := transform.Bytes(e.NewDecoder(), data)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to decode as %v: %v", enc, err)
+	}
+	return decoded, enc, nil
+}
+
+// fromUTF8 converts UTF-8 data into enc.
+// Characters not in enc are replaced, and reported by the returned count.
+func fromUTF8(data []byte, enc string) ([]byte, int, error) {
+	if enc == "" {
+		return data, 0, nil
+	}
+
+	e, found := localEncodings[enc]
+	if !found {
+		return nil, 0, fmt.Errorf("unsupported encoding %q", enc)
+	}
+
+	// BOM is meaningless out of UTF-8
+	data = bytes.TrimPrefix(data, utf8BOM)
+
+	encoded, _, err := transform.Bytes(e.NewEncoder(), data)
+	if err == nil {
+		return encoded, 0, nil
+	}
+
+	replaced := 0
+	for _, r := range string(data) {
+		if _, _, err := transform.String(e.NewEncoder(), string(r)); err != nil {
+			replaced++
+		}
+	}
+	encoded, _, err = transform.Bytes(encoding.ReplaceUnsupported(e.NewEncoder()), data)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to encode as %v: %v", enc, err)
+	}
+	return encoded, replaced, nil
+}
+
+func isISO2022JP(data []byte) bool {
+	return bytes.Contains(data, []byte("\x1b$B")) || bytes.Contains(data, []byte("\x1b$@")) || bytes.Contains(data, []byte("\x1b(J"))
+}
+
+// detectJapaneseEncoding guesses the encoding of data that is not UTF-8.
+// It returns "" if no Japanese encoding fits.
+func detectJapaneseEncoding(data []byte) string {
+	if isISO2022JP(data) {
+		return "iso-2022-jp"
+	}
+
+	sjis := validShiftJIS(data)
+	euc := validEUCJP(data)
+	switch {
+	case sjis && !euc:
+		return "shift_jis"
+	case euc && !sjis:
+		return "euc-jp"
+	case sjis && euc:
+		// hiragana and katakana in EUC-JP lead with 0xa4 and 0xa5, which are half-width katakana in Shift_JIS
+		if countBytes(data, 0xa4, 0xa5) > len(data)/8 {
+			return "euc-jp"
+		}
+		return "shift_jis"
+	}
+	return ""
+}
+
+func countBytes(data []byte, bs ...byte) int {
+	n := 0
+	for _, c := range data {
+		for _, b := range bs {
+			if c == b {
+				n++
+			}
+		}
+	}
+	return n
+}
+
+func validShiftJIS(data []byte) bool {
+	for i := 0; i < len(data); i++ {
+		c := data[i]
+		switch {
+		case c < 0x80, 0xa1 <= c && c <= 0xdf:
+			// ASCII, half-width katakana
+		case 0x81 <= c && c <= 0x9f, 0xe0 <= c && c <= 0xfc:
+			if i+1 >= len(data) {
+				return false
+			}
+			t := data[i+1]
+			if t < 0x40 || t == 0x7f || t > 0xfc {
+				return false
+			}
+			i++
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+func validEUCJP(data []byte) bool {
+	for i := 0; i < len(data); i++ {
+		c := data[i]
+		switch {
+		case c < 0x80:
+		case c == 0x8e: // half-width katakana
+			if i+1 >= len(data) || data[i+1] < 0xa1 || data[i+1] > 0xdf {
+				return false
+			}
+			i++
+		case c == 0x8f: // JIS X 0212
+			if i+2 >= len(data) || data[i+1] < 0xa1 || data[i+2] < 0xa1 || data[i+1] == 0xff || data[i+2] == 0xff {
+				return false
+			}
+			i += 2
+		case 0xa1 <= c && c <= 0xfe:
+			if i+1 >= len(data) || data[i+1] < 0xa1 || data[i+1] > 0xfe {
+				return false
+			}
+			i++
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// decodeLegacyCharset converts the body of a text part written in a Japanese charset by other mail clients into UTF-8.
+// A body already in UTF-8 is left as is.
+func decodeLegacyCharset(msg *mail.Message) error {
+	if s := msg.Header.Get("Subject"); strings.Contains(s, "=?") {
+		if decoded, err := mimeWordDecoder.DecodeHeader(s); err == nil {
+			msg.Header["Subject"] = []string{decoded}
+		}
+	}
+
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil {
+		return nil
+	}
+	enc, err := normalizeEncodingName(params["charset"])
+	if err != nil || enc == "" {
+		return nil
+	}
+
+	body, err := ioutil.ReadAll(msg.Body)
+	if err != nil {
+		return fmt.Errorf("on subject[%v]: body reading error: %v", msg.Header.Get("Subject"), err)
+	}
+	if utf8.Valid(body) && !isISO2022JP(body) {
+		// already converted
+		msg.Body = bytes.NewReader(body)
+		return nil
+	}
+
+	decoded, _, err := toUTF8(body, enc)
+	if err != nil {
+		return fmt.Errorf("on subject[%v]: %v", msg.Header.Get("Subject"), err)
+	}
+	msg.Body = bytes.NewReader(decoded)
+	msg.Header["Content-Type"] = []string{mime.FormatMediaType(mediaType, map[string]string{"charset": "utf-8"})}
+	return nil
+}
+
+var mimeWordDecoder = &mime.WordDecoder{
+	CharsetReader: func(charset string, input io.Reader) (io.Reader, error) {
+		enc, err := normalizeEncodingName(charset)
+		if err != nil {
+			return nil, err
+		}
+		if enc == "" {
+			return input, nil
+		}
+		return transform.NewReader(input, localEncodings[enc].NewDecoder()), nil
+	},
+}
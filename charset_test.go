@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"net/mail"
+	"testing"
+
+	"golang.org/x/text/encoding/japanese"
+	"golang.org/x/text/transform"
+)
+
+func TestJapaneseEncodings(t *testing.T) {
+	text := "ポメラのメモ。漢字とカタカナ、ひらがな。\r\n"
+
+	for name, enc := range localEncodings {
+		encoded, _, err := transform.Bytes(enc.NewEncoder(), []byte(text))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got := detectJapaneseEncoding(encoded); got != name {
+			t.Errorf("detect %v: got %q", name, got)
+		}
+
+		decoded, used, err := toUTF8(encoded, "")
+		if err != nil || used != name || string(decoded) != text {
+			t.Errorf("toUTF8 %v (auto): %q, %q, %v", name, decoded, used, err)
+		}
+
+		back, replaced, err := fromUTF8(append(append([]byte(nil), utf8BOM...), text...), name)
+		if err != nil || replaced != 0 || !bytes.Equal(back, encoded) {
+			t.Errorf("fromUTF8 %v: %q, %v, %v", name, back, replaced, err)
+		}
+	}
+}
+
+func TestToUTF8KeepsUTF8(t *testing.T) {
+	text := []byte("そのまま")
+	if got, used, err := toUTF8(text, ""); err != nil || used != "" || !bytes.Equal(got, text) {
+		t.Errorf("utf-8: %q, %q, %v", got, used, err)
+	}
+
+	bom := append(append([]byte(nil), utf8BOM...), text...)
+	if got, used, err := toUTF8(bom, "shift_jis"); err != nil || used != "" || !bytes.Equal(got, bom) {
+		t.Errorf("utf-8 with BOM as shift_jis: %q, %q, %v", got, used, err)
+	}
+}
+
+func TestFromUTF8Replaces(t *testing.T) {
+	_, replaced, err := fromUTF8([]byte("絵文字😀です"), "shift_jis")
+	if err != nil || replaced != 1 {
+		t.Errorf("got %v, %v", replaced, err)
+	}
+}
+
+func TestDecodeLegacyCharset(t *testing.T) {
+	body, _, _ := transform.Bytes(japanese.ISO2022JP.NewEncoder(), []byte("こんにちは"))
+	msg := &mail.Message{
+		Header: mail.Header{
+			"Subject":      []string{"=?ISO-2022-JP?B?GyRCJDMkcyRLJEEkTxsoQg==?="},
+			"Content-Type": []string{`text/plain; charset="ISO-2022-JP"`},
+		},
+		Body: bytes.NewReader(body),
+	}
+	if err := decodeLegacyCharset(msg); err != nil {
+		t.Fatal(err)
+	}
+	if got := msg.Header.Get("Subject"); got != "こんにちは" {
+		t.Errorf("subject: %q", got)
+	}
+	buff := new(bytes.Buffer)
+	buff.ReadFrom(msg.Body)
+	if buff.String() != "こんにちは" {
+		t.Errorf("body: %q", buff.String())
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+)
+
+type appendCmd struct {
+	Daily      bool   `help:"append to the message of today (subject \"YYYY-MM-DD SUBJECT\")"`
+	Timestamp  bool   `cli:"timestamp, t"  help:"prefix the text with the current time"`
+	TimeFormat string `cli:"time-format=LAYOUT"  default:"15:04"  help:"Go time layout of --timestamp"`
+	Separator  string `cli:"separator=LINE, s"  help:"a line put between the current body and the text"`
+
+	Policy string `cli:"policy=POLICY"  help:"what to do with memos the Pomera can't handle (off, warn, block, fix; default: [POMERA] Policy, or off)"`
+	Split  bool   `help:"split the memo longer than [POMERA] MaxBodyChars into numbered parts (a split memo is split again anyway)"`
+}
+
+func (c appendCmd) Run(g globalCmd, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("specify a subject")
+	}
+
+	now := time.Now()
+	subject := args[0]
+	if c.Daily {
+		subject = now.Format("2006-01-02") + " " + subject
+	}
+
+	var text string
+	if len(args) > 1 {
+		text = strings.Join(args[1:], " ")
+	} else {
+		data, err := ioutil.ReadAll(os.Stdin)
+		if err != nil {
+			return err
+		}
+		text = string(bytes.TrimPrefix(data, utf8BOM))
+	}
+	if c.Timestamp {
+		text = now.Format(c.TimeFormat) + " " + text
+	}
+
+	config, err := g.loadConfig()
+	if err != nil {
+		return err
+	}
+	setAuthVariables(config)
+
+	pomera, err := pomeraPolicyOf(config, c.Policy)
+	if err != nil {
+		return err
+	}
+
+	ic, err := initIMAP(config)
+	if err != nil {
+		return err
+	}
+	defer ic.Logout()
+
+	body := ""
+	ext := "txt"
+	m, split, err := readMemo(ic, subject)
+	if err != nil {
+		return err
+	}
+	if m != nil {
+		b, err := readBody(m)
+		if err != nil {
+			return err
+		}
+		body = string(b)
+		if e := m.Header.Get("X-Pomi-Ext"); e != "" {
+			ext = e
+		}
+	}
+
+	body = appendText(body, text, c.Separator)
+
+	// the same as put, including deleting parts of the memo no longer split
+	opts := putOptions{Pomera: &pomera}
+	if c.Split || split {
+		opts.SplitChars = pomera.MaxBodyChars
+	}
+	parts, err := preparePutParts(opts, subject, subject, []byte(body))
+	if err != nil {
+		return err
+	}
+	err = putParts(ic, config.IMAP.Box, config.IMAP.User, subject, ext, nil, false, parts, now)
+	if err != nil && err != errUnchanged {
+		return err
+	}
+	indexMessage(config, subject, ext, now, bytes.Join(parts, nil))
+
+	if m == nil {
+		fmt.Fprintf(os.Stderr, "created %v\n", subject)
+	}
+
+	return nil
+}
+
+// appendText appends text to body as new lines, following the line ending of body.
+func appendText(body, text, separator string) string {
+	nl := "\n"
+	if strings.Contains(body, "\r\n") {
+		nl = "\r\n"
+	}
+
+	text = strings.Replace(text, "\r\n", "\n", -1)
+	text = strings.TrimRight(text, "\n")
+	text = strings.Replace(text, "\n", nl, -1)
+
+	if body != "" {
+		if !strings.HasSuffix(body, "\n") {
+			body += nl
+		}
+		if separator != "" {
+			body += separator + nl
+		}
+	}
+
+	return body + text + nl
+}
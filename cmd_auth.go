@@ -1,9 +1,11 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"net/url"
 	"os"
@@ -18,7 +20,7 @@ type authCmd struct {
 }
 
 func (c authCmd) Run(g globalCmd) error {
-	config, err := loadConfig(g.Config)
+	config, err := g.loadConfig()
 	if err != nil {
 		return err
 	}
@@ -60,7 +62,7 @@ func (c authCmd) Run(g globalCmd) error {
 	} else {
 		authorizationCode = <-codeChan
 	}
-	//log.Printf("authorization_code=%s\n", authorization_code)
+	addLogSecret(authorizationCode)
 
 	// request access token & request token
 
@@ -71,19 +73,19 @@ func (c authCmd) Run(g globalCmd) error {
 	form.Add("code", authorizationCode)
 	form.Add("redirect_uri", redirectURI)
 	form.Add("grant_type", "authorization_code")
-	resp, err := http.PostForm(tokenURL, form)
+	logTrace("http", "method", "POST", "url", tokenURL, "form", form.Encode())
+	resp, err := postForm(rootCtx, config.httpClient(), tokenURL, form)
 	if err != nil {
 		return err
 	}
 	defer resp.Body.Close()
-	/*
-		{
-			log.Printf("%s&%s", tokenURL, form.Encode())
-			b, _ := ioutil.ReadAll(resp.Body)
-			log.Printf("resp.Body=%s", b)
-		}
-	*/
-	dec := json.NewDecoder(resp.Body)
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	logTrace("http", "url", tokenURL, "status", resp.Status, "body", string(body))
+
+	dec := json.NewDecoder(bytes.NewReader(body))
 	t := oAuth2AuthedTokens{}
 	err = dec.Decode(&t)
 	if err == io.EOF {
@@ -92,6 +94,8 @@ func (c authCmd) Run(g globalCmd) error {
 		return err
 	}
 	config.AUTH.RefreshToken = t.RefreshToken
+	addLogSecret(t.RefreshToken)
+	addLogSecret(t.AccessToken)
 
 	// get email address
 
@@ -100,22 +104,25 @@ func (c authCmd) Run(g globalCmd) error {
 	form.Add("access_token", t.AccessToken)
 	form.Add("alt", "json")
 	//inforesp, err := http.PostForm(infoURL, form)
-	inforesp, err := http.Get(fmt.Sprintf("%s?%s", infoURL, form.Encode()))
+	inforeq, err := http.NewRequestWithContext(rootCtx, "GET", fmt.Sprintf("%s?%s", infoURL, form.Encode()), nil)
+	if err != nil {
+		return err
+	}
+	logTrace("http", "method", "GET", "url", inforeq.URL.String())
+	inforesp, err := config.httpClient().Do(inforeq)
 	if err != nil {
 		// save with User unchanged.
 		saveConfig(config, g.Config)
 		return fmt.Errorf("failed to get email address: %v", err)
 	}
 	defer inforesp.Body.Close()
-	/*
-		 {
-			log.Printf("%s&%s", infoURL, form.Encode())
-			b, _ := ioutil.ReadAll(inforesp.Body)
-			log.Printf("inforesp.Body=%s", b)
-		}
-	*/
-
-	dec = json.NewDecoder(inforesp.Body)
+	body, err = ioutil.ReadAll(inforesp.Body)
+	if err != nil {
+		return err
+	}
+	logTrace("http", "url", infoURL, "status", inforesp.Status, "body", string(body))
+
+	dec = json.NewDecoder(bytes.NewReader(body))
 	e := oAuth2Email{}
 	err = dec.Decode(&e)
 	if err == io.EOF {
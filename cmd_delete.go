@@ -1,24 +1,59 @@
 package main
 
+import (
+	"fmt"
+	"os"
+)
+
 type deleteCmd struct {
 	All     bool   `help:"delete all messages"`
 	Seq     string `help:"delete by seq. (comma seprated or s1:s2)"`
 	Subject string `cli:"subject, subj"  help:"delete by subject"`
+	Query   string `cli:"query=QUERY, q"  help:"delete by query (e.g. \"subject:memo since:2024-01-01 not body:draft\")"`
 }
 
 func (c deleteCmd) Run(g globalCmd) error {
-	config, err := loadConfig(g.Config)
+	config, err := g.loadConfig()
 	if err != nil {
 		return err
 	}
 	setAuthVariables(config)
 
-	ic, err := initIMAP(config)
+	ctx, cancel := commandContext(config)
+	defer cancel()
+
+	ic, err := initIMAPContext(ctx, config)
 	if err != nil {
 		return err
 	}
 
-	err = deleteMessage(ic, c.All, c.Subject, c.Seq)
+	seq := c.Seq
+	if c.Query != "" {
+		if seq, err = resolveSeqByQuery(ic, c.Query); err != nil {
+			ic.Logout()
+			return err
+		}
+	}
+
+	p := newProgress(os.Stderr, "delete")
+	deleted, err := deleteMessageWithProgress(ic, c.All, c.Subject, seq, p)
+	p.finish()
+	if err != nil {
+		return err
+	}
+
+	if len(deleted) > 0 {
+		idx, ierr := openSearchIndex(indexPath(config))
+		if ierr == nil {
+			for _, subject := range deleted {
+				idx.remove(subject)
+			}
+			ierr = idx.save()
+		}
+		if ierr != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", ierr)
+		}
+	}
 
-	return err
+	return nil
 }
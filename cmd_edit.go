@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/mail"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type editCmd struct {
+	Seq   string `help:"edit by seq. instead of a subject"`
+	Force bool   `help:"put even if the message was modified on the server while editing"`
+
+	Encoding   string `cli:"encoding=ENC"  help:"encoding of the file to edit (utf-8, shift_jis, euc-jp, iso-2022-jp; default: [LOCAL] Encoding)"`
+	LineEnding string `cli:"eol=EOL"  help:"line ending of the file to edit (lf, crlf, preserve; default: [LOCAL] LineEnding)"`
+}
+
+func (c editCmd) Run(g globalCmd, args []string) error {
+	var target string
+	switch {
+	case c.Seq == "" && len(args) == 1:
+		target = args[0]
+	case c.Seq != "" && len(args) == 0:
+	default:
+		return fmt.Errorf("specify a subject or --seq")
+	}
+
+	config, err := g.loadConfig()
+	if err != nil {
+		return err
+	}
+	setAuthVariables(config)
+
+	// the file to edit is the same as got by get
+	local, err := localFormatOf(config, c.Encoding, c.LineEnding)
+	if err != nil {
+		return err
+	}
+
+	ic, err := initIMAP(config)
+	if err != nil {
+		return err
+	}
+	subject, orig, err := fetchEditingMessage(ic, target, c.Seq)
+	ic.Logout()
+	if err != nil {
+		return err
+	}
+
+	ext := orig.Header.Get("X-Pomi-Ext")
+	if ext == "" {
+		ext = "txt"
+	}
+	origBody, err := readBody(orig)
+	if err != nil {
+		return err
+	}
+	localBody, err := local.toLocal(subject, origBody)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile("", "pomi-*."+ext)
+	if err != nil {
+		return err
+	}
+	tmpName := tmp.Name()
+	_, err = tmp.Write(localBody)
+	tmp.Close()
+	if err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+
+	if err := launchEditor(tmpName); err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+
+	edited, err := ioutil.ReadFile(tmpName)
+	if err != nil {
+		return err
+	}
+	if bytes.Equal(edited, localBody) {
+		os.Remove(tmpName)
+		fmt.Fprintf(os.Stderr, "unchanged\n")
+		return nil
+	}
+
+	// the editor may have been open for a long time
+	ic, err = initIMAP(config)
+	if err != nil {
+		return fmt.Errorf("%v (edited file is kept at %v)", err, tmpName)
+	}
+	defer ic.Logout()
+
+	if !c.Force {
+		if err := checkUnmodified(ic, local, subject, orig, origBody, tmpName); err != nil {
+			return err
+		}
+	}
+
+	remote, err := local.toRemote(tmpName, edited)
+	if err != nil {
+		return fmt.Errorf("%v (edited file is kept at %v)", err, tmpName)
+	}
+	tm := time.Now()
+	err = putMessage(ic, config.IMAP.Box, config.IMAP.User, subject, ext, bytes.NewReader(remote), tm)
+	if err != nil {
+		return fmt.Errorf("%v (edited file is kept at %v)", err, tmpName)
+	}
+	os.Remove(tmpName)
+	indexMessage(config, subject, ext, tm, remote)
+	fmt.Fprintf(os.Stderr, "put %v\n", subject)
+
+	return nil
+}
+
+// fetchEditingMessage fetches a message by an exact subject, or by seqStr if not empty.
+func fetchEditingMessage(ic *imapConn, target, seqStr string) (string, *mail.Message, error) {
+	if seqStr != "" {
+		seq, err := strconv.ParseUint(seqStr, 10, 32)
+		if err != nil {
+			return "", nil, fmt.Errorf("invalid seq %q", seqStr)
+		}
+		mm, err := ic.Fetch(strconv.FormatUint(seq, 10))
+		if err != nil {
+			return "", nil, err
+		}
+		m, found := mm[uint32(seq)]
+		if !found {
+			return "", nil, fmt.Errorf("no message at seq %v", seq)
+		}
+		textMsg, err := decodeMessageAsTextMessage(m, false)
+		if err != nil {
+			return "", nil, err
+		}
+		return textMsg.Header.Get("Subject"), textMsg, nil
+	}
+
+	seq, m, err := findMessageBySubject(ic, target)
+	if err != nil {
+		return "", nil, err
+	}
+	if seq == 0 {
+		return "", nil, fmt.Errorf("no message with subject %q", target)
+	}
+	return target, m, nil
+}
+
+// checkUnmodified fails if the message has been changed or deleted since orig was fetched.
+// The current one is saved next to the edited file in local to be merged by hand.
+func checkUnmodified(ic *imapConn, local localFormat, subject string, orig *mail.Message, origBody []byte, editedName string) error {
+	seq, current, err := findMessageBySubject(ic, subject)
+	if err != nil {
+		return err
+	}
+	if seq == 0 {
+		return fmt.Errorf("%q was deleted on the server while editing (edited file is kept at %v)", subject, editedName)
+	}
+
+	currentBody, err := readBody(current)
+	if err != nil {
+		return err
+	}
+	if current.Header.Get("Date") == orig.Header.Get("Date") && bytes.Equal(currentBody, origBody) {
+		return nil
+	}
+
+	remoteName := editedName + ".remote"
+	data, err := local.toLocal(subject, currentBody)
+	if err == nil {
+		err = ioutil.WriteFile(remoteName, data, 0600)
+	}
+	if err != nil {
+		remoteName = "(failed to save: " + err.Error() + ")"
+	}
+	return fmt.Errorf("%q was modified on the server while editing.\nedited: %v\nremote: %v\nmerge them and put the result", subject, editedName, remoteName)
+}
+
+// readBody reads the body of msg without BOM.
+func readBody(msg *mail.Message) ([]byte, error) {
+	body, err := ioutil.ReadAll(msg.Body)
+	if err != nil {
+		return nil, fmt.Errorf("on subject[%v]: body reading error: %v", msg.Header.Get("Subject"), err)
+	}
+	return bytes.TrimPrefix(body, utf8BOM), nil
+}
+
+// launchEditor opens name with $VISUAL or $EDITOR and waits for it.
+func launchEditor(name string) error {
+	editor := os.Getenv("VISUAL")
+	if editor == "" {
+		editor = os.Getenv("EDITOR")
+	}
+	if editor == "" {
+		if runtime.GOOS == "windows" {
+			editor = "notepad"
+		} else {
+			editor = "vi"
+		}
+	}
+
+	fields := strings.Fields(editor)
+	cmd := exec.Command(fields[0], append(fields[1:], name)...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("editor %q failed: %v", editor, err)
+	}
+	return nil
+}
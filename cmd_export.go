@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+type exportCmd struct {
+	Format string `cli:"format=FORMAT, f"  default:"html"  help:"output format (html)"`
+}
+
+func (c exportCmd) Run(g globalCmd, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("specify an output directory")
+	}
+	dir := args[0]
+
+	if c.Format != "html" {
+		return fmt.Errorf("unsupported format %q", c.Format)
+	}
+
+	config, err := g.loadConfig()
+	if err != nil {
+		return err
+	}
+	setAuthVariables(config)
+
+	ctx, cancel := commandContext(config)
+	defer cancel()
+
+	ic, err := initIMAPContext(ctx, config)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		ic.Logout()
+		return err
+	}
+
+	exporter := &htmlExporter{}
+	opts := getOptions{
+		Reconnect: func() (*imapConn, error) {
+			return openIMAP(ctx, config)
+		},
+		Retry:    config.retryPolicy(),
+		Progress: newProgress(os.Stderr, "export"),
+	}
+	err = getMessagesWithOptions(ctx, ic, false, true, "", "", dir, "txt", opts, exporter.writer())
+	ic.Logout()
+	opts.Progress.finish()
+	if err != nil {
+		return err
+	}
+
+	err = exporter.write(dir)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "exported %d messages to %v\n", len(exporter.memos), dir)
+
+	return nil
+}
@@ -1,27 +1,99 @@
 package main
 
+import (
+	"fmt"
+	"os"
+)
+
 type getCmd struct {
 	All     bool   `help:"fetch all messages"`
 	Seq     string `help:"fetch by seq. (comma seprated or s1:s2)"`
 	Subject string `cli:"subject, subj"  help:"fetch by subject"`
+	Query   string `cli:"query=QUERY, q"  help:"fetch by query (e.g. \"subject:memo since:2024-01-01 tag:work not body:draft\")"`
 	Ext     string `cli:"ext, e"  default:"txt"  help:"file extension"`
 	Header  bool   `cli:"header, H"  help:"output mail headers"`
+	Batch   int    `cli:"batch=N"  default:"100"  help:"number of messages fetched at once"`
+	Jobs    int    `cli:"jobs=N, j"  default:"4"  help:"number of messages written concurrently"`
+	NoJoin  bool   `cli:"no-join"  help:"write parts of a memo split by put --split as they are"`
+
+	Attachments string `cli:"attachments=DIR"  help:"save attachments (non-text parts) in DIR/SUBJECT/"`
+	Body        string `cli:"body=TYPE"  default:"plain"  help:"body of a message having both text/plain and text/html (plain, html)"`
+	RawHTML     bool   `cli:"raw-html"  help:"keep HTML bodies as they are instead of converting them into text"`
+
+	NoFrontMatter bool `cli:"no-front-matter"  help:"do not regenerate front matter of memos put with it"`
+
+	Encoding   string `cli:"encoding=ENC"  help:"encoding of local files (utf-8, shift_jis, euc-jp, iso-2022-jp; default: [LOCAL] Encoding)"`
+	LineEnding string `cli:"eol=EOL"  help:"line ending of local files (lf, crlf, preserve; default: [LOCAL] LineEnding)"`
 }
 
 func (c getCmd) Run(g globalCmd) error {
-	config, err := loadConfig(g.Config)
+	config, err := g.loadConfig()
 	if err != nil {
 		return err
 	}
 	setAuthVariables(config)
 
-	ic, err := initIMAP(config)
+	local, err := localFormatOf(config, c.Encoding, c.LineEnding)
+	if err != nil {
+		return err
+	}
+
+	body, err := normalizeBodyType(c.Body)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := commandContext(config)
+	defer cancel()
+
+	ic, err := initIMAPContext(ctx, config)
 	if err != nil {
 		return err
 	}
 
-	err = getMessages(ic, c.Header, c.All, c.Subject, c.Seq, g.Dir, c.Ext, filesWriter)
+	seq := c.Seq
+	if c.Query != "" {
+		if seq, err = resolveSeqByQuery(ic, c.Query); err != nil {
+			ic.Logout()
+			return err
+		}
+	}
+
+	// indexed after the conversion, the same as put indexes local files
+	writer := filesWriter
+	idx, ierr := openSearchIndex(indexPath(config))
+	if ierr != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", ierr)
+	} else if !c.Header {
+		writer = idx.writer(local, writer)
+	}
+	writer = local.writer(writer)
+
+	opts := getOptions{
+		BatchSize: c.Batch,
+		Jobs:      c.Jobs,
+		Reconnect: func() (*imapConn, error) {
+			return openIMAP(ctx, config)
+		},
+		Retry:    config.retryPolicy(),
+		Progress: newProgress(os.Stderr, "get"),
+		Join:     !c.NoJoin,
+
+		Body:        body,
+		Attachments: c.Attachments,
+		RawHTML:     c.RawHTML,
+		FrontMatter: !c.NoFrontMatter,
+	}
+
+	err = getMessagesWithOptions(ctx, ic, c.Header, c.All, c.Subject, seq, g.Dir, c.Ext, opts, writer)
 	ic.Logout()
+	opts.Progress.finish()
+
+	if idx != nil {
+		if ierr := idx.save(); ierr != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", ierr)
+		}
+	}
 
 	return err
 }
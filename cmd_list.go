@@ -7,11 +7,17 @@ import (
 )
 
 type listCmd struct {
-	Criteria string `cli:"criteria=SEARCH_KEY, c"  default:"SUBJECT"  help:"filter by the search key"`
+	Criteria string `cli:"criteria=SEARCH_KEY, c"  default:"SUBJECT"  help:"search key for words without a key. (args are a query like \"subject:memo since:2024-01-01 larger:2k tag:work is:pinned not body:draft\")"`
+	Format   string `cli:"format=FORMAT, f"  help:"output format (text, long, json, jsonl, csv, tsv)"`
+	Sort     string `cli:"sort=KEY"  default:"seq"  help:"sort by seq, date, subject or size"`
+	Reverse  bool   `cli:"reverse, r"  help:"reverse the order"`
+	Limit    int    `cli:"limit=N, n"  help:"list at most N messages"`
+	Offset   int    `cli:"offset=N"  help:"skip the first N messages"`
+	Template string `cli:"template=TEMPLATE, t"  help:"output each message by a Go template over .Seq .UID .Subject .Date .Ext .Size .Flags .Tags (e.g. \"{{.UID}} {{.Subject}}\")"`
 }
 
 func (c listCmd) Run(g globalCmd, args []string) error {
-	config, err := loadConfig(g.Config)
+	config, err := g.loadConfig()
 	if err != nil {
 		return err
 	}
@@ -23,19 +29,23 @@ func (c listCmd) Run(g globalCmd, args []string) error {
 	}
 
 	keyword := strings.Join(args, " ")
-	list, err := listMessages(ic, c.Criteria, keyword)
+	opts := listOptions{
+		Size:    c.Format != "" || strings.Contains(c.Template, ".Size") || c.Sort == "size",
+		Sort:    c.Sort,
+		Reverse: c.Reverse,
+		Limit:   c.Limit,
+		Offset:  c.Offset,
+	}
+	list, err := listMessagesWithOptions(ic, c.Criteria, keyword, opts)
 	if err != nil {
 		return fmt.Errorf("listing error: %v", err)
 	}
 	ic.Logout()
 
-	if len(list) == 0 {
+	if len(list) == 0 && c.Format == "" && c.Template == "" {
 		fmt.Fprintf(os.Stderr, "no messages\n")
-	} else {
-		for _, e := range list {
-			fmt.Printf("%d %v (%v)\n", e.Seq, e.Subject, e.Date)
-		}
+		return nil
 	}
 
-	return nil
+	return writeList(os.Stdout, list, c.Format, c.Template)
 }
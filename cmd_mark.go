@@ -0,0 +1,24 @@
+package main
+
+type markCmd struct {
+	Read   markReadCmd   `help:"mark messages as read"`
+	Unread markUnreadCmd `help:"mark messages as unread"`
+}
+
+type markReadCmd struct {
+	Seq   string `help:"mark by seq. (comma seprated or s1:s2)"`
+	Query string `cli:"query=QUERY, q"  help:"mark by query (e.g. \"is:unread since:2024-01-01\")"`
+}
+
+func (c markReadCmd) Run(g globalCmd, args []string) error {
+	return runFlagChange(g, args, c.Seq, c.Query, flagSeen, true, "marked as read")
+}
+
+type markUnreadCmd struct {
+	Seq   string `help:"mark by seq. (comma seprated or s1:s2)"`
+	Query string `cli:"query=QUERY, q"  help:"mark by query (e.g. \"tag:todo\")"`
+}
+
+func (c markUnreadCmd) Run(g globalCmd, args []string) error {
+	return runFlagChange(g, args, c.Seq, c.Query, flagSeen, false, "marked as unread")
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+)
+
+type newCmd struct {
+	Template string `cli:"template=NAME, t"  help:"template name (a file NAME.* in [TEMPLATE] Dir)"`
+	Edit     bool   `cli:"edit, e"  help:"edit with $VISUAL or $EDITOR before putting"`
+	Force    bool   `help:"overwrite a message with the same subject"`
+}
+
+const counterFileName = ".pomi_counter.json"
+
+// templateVars are passed to templates of subjects and bodies.
+type templateVars struct {
+	Subject string
+	Date    string
+	Time    string
+	User    string
+	Counter int
+	Now     time.Time
+}
+
+func (c newCmd) Run(g globalCmd, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("specify a subject")
+	}
+
+	config, err := g.loadConfig()
+	if err != nil {
+		return err
+	}
+	setAuthVariables(config)
+
+	dir := templateDir(config)
+	counters, err := loadCounters(dir)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	vars := templateVars{
+		Date:    now.Format("2006-01-02"),
+		Time:    now.Format("15:04"),
+		User:    config.IMAP.User,
+		Counter: counters[c.Template] + 1,
+		Now:     now,
+	}
+	if vars.User == "" {
+		vars.User = os.Getenv("USER")
+	}
+
+	subject, err := renderTemplate("subject", strings.Join(args, " "), vars)
+	if err != nil {
+		return err
+	}
+	vars.Subject = subject
+
+	ext := "txt"
+	var body []byte
+	if c.Template != "" {
+		name, err := findTemplate(dir, c.Template)
+		if err != nil {
+			return err
+		}
+		if e := filepath.Ext(name); e != "" {
+			ext = e[1:]
+		}
+
+		src, err := ioutil.ReadFile(name)
+		if err != nil {
+			return err
+		}
+		rendered, err := renderTemplate(c.Template, string(bytes.TrimPrefix(src, utf8BOM)), vars)
+		if err != nil {
+			return err
+		}
+		body = []byte(rendered)
+	}
+
+	if c.Edit {
+		body, err = editText(body, ext)
+		if err != nil {
+			return err
+		}
+	}
+
+	ic, err := initIMAP(config)
+	if err != nil {
+		return err
+	}
+	defer ic.Logout()
+
+	if !c.Force {
+		seq, _, err := findMessageBySubject(ic, subject)
+		if err != nil {
+			return err
+		}
+		if seq != 0 {
+			return fmt.Errorf("%q already exists (use --force to overwrite)", subject)
+		}
+	}
+
+	err = putMessage(ic, config.IMAP.Box, config.IMAP.User, subject, ext, bytes.NewReader(body), now)
+	if err != nil {
+		return err
+	}
+	indexMessage(config, subject, ext, now, body)
+	fmt.Fprintf(os.Stderr, "put %v\n", subject)
+
+	if c.Template != "" {
+		counters[c.Template] = vars.Counter
+		if err := saveCounters(dir, counters); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to save the counter: %v\n", err)
+		}
+	}
+
+	return nil
+}
+
+func templateDir(config *config) string {
+	if config.TEMPLATE.Dir != "" {
+		return config.TEMPLATE.Dir
+	}
+	return filepath.Join(filepath.Dir(config.path), "templates")
+}
+
+// findTemplate returns the path of a template file NAME.* in dir.
+func findTemplate(dir, name string) (string, error) {
+	matches, err := filepath.Glob(filepath.Join(dir, name+".*"))
+	if err != nil {
+		return "", err
+	}
+	if len(matches) == 0 {
+		return "", fmt.Errorf("template %q is not found in %v", name, dir)
+	}
+	if len(matches) > 1 {
+		return "", fmt.Errorf("template %q is ambiguous: %v", name, strings.Join(matches, ", "))
+	}
+	return matches[0], nil
+}
+
+func renderTemplate(name, src string, vars templateVars) (string, error) {
+	t, err := template.New(name).Parse(src)
+	if err != nil {
+		return "", fmt.Errorf("template %q: %v", name, err)
+	}
+
+	buff := new(bytes.Buffer)
+	if err := t.Execute(buff, vars); err != nil {
+		return "", fmt.Errorf("template %q: %v", name, err)
+	}
+	return buff.String(), nil
+}
+
+// loadCounters loads counters of templates in dir.
+func loadCounters(dir string) (map[string]int, error) {
+	counters := make(map[string]int)
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, counterFileName))
+	if os.IsNotExist(err) {
+		return counters, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, &counters); err != nil {
+		return nil, fmt.Errorf("broken counter file in %v: %v", dir, err)
+	}
+	return counters, nil
+}
+
+func saveCounters(dir string, counters map[string]int) error {
+	data, err := json.Marshal(counters)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, counterFileName), data, 0600)
+}
+
+// editText lets the user edit text in a temp file with ext.
+func editText(text []byte, ext string) ([]byte, error) {
+	tmp, err := ioutil.TempFile("", "pomi-*."+ext)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(text)
+	tmp.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := launchEditor(tmp.Name()); err != nil {
+		return nil, err
+	}
+	return ioutil.ReadFile(tmp.Name())
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+type pinCmd struct {
+	Seq   string `help:"pin by seq. (comma seprated or s1:s2)"`
+	Query string `cli:"query=QUERY, q"  help:"pin by query (e.g. \"tag:work since:2024-01-01\")"`
+}
+
+func (c pinCmd) Run(g globalCmd, args []string) error {
+	return runFlagChange(g, args, c.Seq, c.Query, flagFlagged, true, "pinned")
+}
+
+type unpinCmd struct {
+	Seq   string `help:"unpin by seq. (comma seprated or s1:s2)"`
+	Query string `cli:"query=QUERY, q"  help:"unpin by query (e.g. \"is:pinned before:2024-01-01\")"`
+}
+
+func (c unpinCmd) Run(g globalCmd, args []string) error {
+	return runFlagChange(g, args, c.Seq, c.Query, flagFlagged, false, "unpinned")
+}
+
+// runFlagChange sets or clears flag on messages of exact subjects in args, of seq, or matched by query.
+func runFlagChange(g globalCmd, args []string, seq, query, flag string, add bool, done string) error {
+	if len(args) == 0 && seq == "" && query == "" {
+		return fmt.Errorf("specify subjects, --seq or --query")
+	}
+
+	config, err := g.loadConfig()
+	if err != nil {
+		return err
+	}
+	setAuthVariables(config)
+
+	ic, err := initIMAP(config)
+	if err != nil {
+		return err
+	}
+	defer ic.Logout()
+
+	var seqs []uint32
+	for _, subject := range args {
+		found, err := findMessagesBySubject(ic, subject)
+		if err != nil {
+			return err
+		}
+		if len(found) == 0 {
+			return fmt.Errorf("no message with subject %q", subject)
+		}
+		for _, f := range found {
+			seqs = append(seqs, f.Seq)
+		}
+	}
+	if query != "" {
+		if seq, err = resolveSeqByQuery(ic, query); err != nil {
+			return err
+		}
+		if seq == "" {
+			fmt.Fprintf(os.Stderr, "no matches\n")
+			return nil
+		}
+	}
+	if seq != "" {
+		// a sequence set is a search key
+		matched, err := ic.Search(seq)
+		if err != nil {
+			return err
+		}
+		seqs = append(seqs, matched...)
+	}
+	if len(seqs) == 0 {
+		fmt.Fprintf(os.Stderr, "no matches\n")
+		return nil
+	}
+
+	if err := storeFlag(ic, joinUint32(seqs, ","), flag, add); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "%d message(s) %v\n", len(seqSet(seqs)), done)
+	return nil
+}
@@ -6,41 +6,74 @@ import (
 )
 
 type putCmd struct {
-	Name string `help:"if rom stdin, specify the name of a message"`
+	Name string `help:"put stdin as a message of the name (SUBJECT or SUBJECT.EXT)"`
+	Ext  string `cli:"ext, e"  help:"file extension of the message from stdin (X-Pomi-Ext)"`
+	Jobs int    `cli:"jobs=N, j"  default:"4"  help:"number of files put concurrently"`
+
+	Encoding   string `cli:"encoding=ENC"  help:"encoding of local files (utf-8, shift_jis, euc-jp, iso-2022-jp; default: [LOCAL] Encoding)"`
+	LineEnding string `cli:"eol=EOL"  help:"line ending of local files (lf, crlf, preserve; default: [LOCAL] LineEnding)"`
+	Policy     string `cli:"policy=POLICY"  help:"what to do with memos the Pomera can't handle (off, warn, block, fix; default: [POMERA] Policy, or off)"`
+	Split      bool   `help:"split a memo longer than [POMERA] MaxBodyChars into numbered parts"`
+
+	NoFrontMatter bool `cli:"no-front-matter"  help:"put front matter (title, date, tags) at the top of files as it is, not as headers"`
 }
 
 func (c putCmd) Run(g globalCmd, args []string) error {
-	config, err := loadConfig(g.Config)
+	config, err := g.loadConfig()
 	if err != nil {
 		return err
 	}
 	setAuthVariables(config)
 
-	ic, err := initIMAP(config)
+	ctx, cancel := commandContext(config)
+	defer cancel()
+
+	ic, err := initIMAPContext(ctx, config)
 	if err != nil {
 		return err
 	}
-	ic.Logout() // re-connect in goroutine
+	ic.Logout() // re-connect in workers (the access token is reused)
 
-	disp := func(fn string, err error) {
-		if err == nil {
-			fmt.Fprintf(os.Stderr, "putting %v\n", fn)
-		} else {
-			fmt.Fprintf(os.Stderr, "failed to put file %v: %v\n", fn, err)
-		}
+	local, err := localFormatOf(config, c.Encoding, c.LineEnding)
+	if err != nil {
+		return err
+	}
+
+	pomera, err := pomeraPolicyOf(config, c.Policy)
+	if err != nil {
+		return err
 	}
 
+	var disp func(string, error)
+	opts := putOptions{Jobs: c.Jobs, Local: local, Pomera: &pomera, FrontMatter: !c.NoFrontMatter}
+	if c.Split {
+		opts.SplitChars = pomera.MaxBodyChars
+	}
 	if len(c.Name) == 0 {
 		fmt.Fprintf(os.Stderr, "searching files in %v\n", g.Dir)
+		opts.Progress = newProgress(os.Stderr, "put")
 	} else {
-		fmt.Fprintf(os.Stderr, "searching files from stdin as %v\n", c.Name)
+		fmt.Fprintf(os.Stderr, "reading stdin as %v\n", c.Name)
+		disp = func(fn string, err error) {
+			if err == nil {
+				fmt.Fprintf(os.Stderr, "putting %v\n", fn)
+			} else {
+				fmt.Fprintf(os.Stderr, "failed to put %v: %v\n", fn, err)
+			}
+		}
+	}
+
+	name := c.Name
+	if name != "" && c.Ext != "" {
+		name += "." + c.Ext
 	}
 
-	cnt, err := putMessages(config, g.Dir, args, c.Name, disp)
+	cnt, err := putMessagesWithOptions(ctx, config, g.Dir, args, name, opts, disp)
+	opts.Progress.finish()
 	if err != nil {
 		return err
 	}
-	if cnt == 0 {
+	if cnt == 0 && opts.Progress.empty() {
 		fmt.Fprintf(os.Stderr, "no matches\n")
 	}
 
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"fmt"
+	"mime"
+	"os"
+	"path/filepath"
+
+	"github.com/shu-go/imapclient"
+)
+
+type renameCmd struct {
+	Force bool `help:"overwrite a message (and a local file) with the new subject"`
+}
+
+func (c renameCmd) Run(g globalCmd, args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("specify an old subject and a new subject")
+	}
+	oldSubject, newSubject := args[0], args[1]
+	if oldSubject == newSubject {
+		return fmt.Errorf("same subjects")
+	}
+
+	config, err := g.loadConfig()
+	if err != nil {
+		return err
+	}
+	setAuthVariables(config)
+
+	ic, err := initIMAP(config)
+	if err != nil {
+		return err
+	}
+	defer ic.Logout()
+
+	ext, err := renameMessage(ic, config.IMAP.Box, oldSubject, newSubject, c.Force)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "renamed %v -> %v\n", oldSubject, newSubject)
+
+	oldName := filepath.Join(g.Dir, oldSubject+"."+ext)
+	newName := filepath.Join(g.Dir, newSubject+"."+ext)
+	if _, err := os.Stat(oldName); err == nil {
+		if _, err := os.Stat(newName); err == nil && !c.Force {
+			fmt.Fprintf(os.Stderr, "%v is kept because %v exists\n", oldName, newName)
+		} else if err := os.Rename(oldName, newName); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to rename %v: %v\n", oldName, err)
+		}
+	}
+
+	idx, err := openSearchIndex(indexPath(config))
+	if err == nil {
+		if doc, found := idx.Docs[oldSubject]; found {
+			idx.remove(oldSubject)
+			idx.add(newSubject, doc.Ext, doc.Date, []byte(doc.Body))
+		}
+		err = idx.save()
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+	}
+
+	return nil
+}
+
+// renameMessage replaces the Subject header of the message oldSubject,
+// or of all parts of the memo oldSubject split by put --split (and their X-Pomi-Parent).
+// The rest of the message (body, Date, X-Pomi-Ext, other parts), its flags and tags are kept as is.
+// It returns the file extension of the message.
+func renameMessage(ic *imapConn, box, oldSubject, newSubject string, force bool) (string, error) {
+	seq, textMsg, err := findMessageBySubject(ic, oldSubject)
+	if err != nil {
+		return "", err
+	}
+
+	var renamings []renaming
+	var ext string
+	if seq != 0 {
+		if parent, _, _, ok := parsePart(textMsg); ok {
+			return "", fmt.Errorf("%q is a part of %q (rename %q instead)", oldSubject, parent, parent)
+		}
+		renamings = []renaming{{seq: seq, subject: newSubject}}
+		ext = textMsg.Header.Get("X-Pomi-Ext")
+	} else {
+		renamings, ext, err = findPartRenamings(ic, oldSubject, newSubject)
+		if err != nil {
+			return "", err
+		}
+		if len(renamings) == 0 {
+			return "", fmt.Errorf("no message with subject %q", oldSubject)
+		}
+	}
+	if ext == "" {
+		ext = "txt"
+	}
+
+	// the new subject of the whole memo, and of each part
+	newSubjects := []string{newSubject}
+	if renamings[0].parent != "" {
+		for _, r := range renamings {
+			newSubjects = append(newSubjects, r.subject)
+		}
+	}
+	var dupSeqs []uint32
+	for _, s := range newSubjects {
+		dupSeq, _, err := findMessageBySubject(ic, s)
+		if err != nil {
+			return "", err
+		}
+		if dupSeq != 0 && !force {
+			return "", fmt.Errorf("%q already exists (use --force to overwrite)", s)
+		}
+		if dupSeq != 0 {
+			dupSeqs = append(dupSeqs, dupSeq)
+		}
+	}
+
+	oldSeqs := make([]uint32, len(renamings))
+	for i, r := range renamings {
+		oldSeqs[i] = r.seq
+	}
+	mm, err := ic.Fetch(joinUint32(oldSeqs, ","))
+	if err != nil {
+		return "", err
+	}
+	for _, r := range renamings {
+		raw, found := mm[r.seq]
+		if !found {
+			return "", fmt.Errorf("failed to fetch %q", oldSubject)
+		}
+		raw.Header["Subject"] = []string{mime.BEncoding.Encode("utf-8", r.subject)}
+		if r.parent != "" {
+			raw.Header[parentHeader] = []string{encodeHeader(r.parent)}
+		}
+	}
+
+	flags, err := fetchFlags(ic, joinUint32(oldSeqs, ","))
+	if err != nil {
+		return "", fmt.Errorf("failed to fetch flags: %v", err)
+	}
+	keywords, err := keywordTags(ic, joinUint32(oldSeqs, ","))
+	if err != nil {
+		return "", fmt.Errorf("failed to fetch flags: %v", err)
+	}
+
+	expungeMu.Lock()
+	defer expungeMu.Unlock()
+
+	// an interrupt waits for the replacement not to leave both the old and the new
+	err = critical(func() error {
+		// append first not to lose the message
+		for _, r := range renamings {
+			if err := ic.Append(box, append(flags[r.seq], keywords[r.seq]...), *mm[r.seq]); err != nil {
+				return fmt.Errorf("message append error of %q: %v", r.subject, err)
+			}
+		}
+
+		deleted := joinUint32(append(oldSeqs, dupSeqs...), ",")
+		if err := ic.Store(deleted, "+FLAGS", []string{imapclient.FlagDeleted}); err != nil {
+			return fmt.Errorf("flag set error of %q: %v", oldSubject, err)
+		}
+		if err := ic.Expunge(); err != nil {
+			return fmt.Errorf("delete error of %q: %v", oldSubject, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return ext, nil
+}
+
+// renaming is a message to be renamed to subject.
+type renaming struct {
+	seq     uint32
+	subject string
+	parent  string // X-Pomi-Parent of a part
+}
+
+// findPartRenamings returns renamings of the parts of the memo oldSubject to newSubject, and its file extension.
+func findPartRenamings(ic *imapConn, oldSubject, newSubject string) ([]renaming, string, error) {
+	parts, err := findParts(ic, oldSubject)
+	if err != nil {
+		return nil, "", err
+	}
+
+	var renamings []renaming
+	var ext string
+	for _, p := range parts {
+		renamings = append(renamings, renaming{seq: p.Seq, subject: partSubject(newSubject, p.I, p.N), parent: newSubject})
+		ext = p.Msg.Header.Get("X-Pomi-Ext")
+	}
+	return renamings, ext, nil
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+type searchCmd struct {
+	Rebuild bool `help:"fetch all messages from the server and rebuild the local index"`
+	Limit   int  `cli:"limit=N, n"  default:"20"  help:"max number of hits. 0 is unlimited."`
+}
+
+func (c searchCmd) Run(g globalCmd, args []string) error {
+	config, err := g.loadConfig()
+	if err != nil {
+		return err
+	}
+
+	idx, err := openSearchIndex(indexPath(config))
+	if err != nil {
+		return err
+	}
+
+	if c.Rebuild {
+		setAuthVariables(config)
+
+		ic, err := initIMAP(config)
+		if err != nil {
+			return err
+		}
+
+		idx.clear()
+		discard := func(string, string, string, time.Time, io.Reader) error { return nil }
+		err = getMessages(ic, false, true, "", "", ".", "txt", idx.writer(localFormat{}, discard))
+		ic.Logout()
+		if err != nil {
+			return err
+		}
+		if err := idx.save(); err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "indexed %d messages\n", len(idx.Docs))
+	}
+
+	query := strings.Join(args, " ")
+	if strings.TrimSpace(query) == "" {
+		if c.Rebuild {
+			return nil
+		}
+		return fmt.Errorf("specify search words")
+	}
+	if len(idx.Docs) == 0 {
+		return fmt.Errorf("the local index is empty. run get or search --rebuild first")
+	}
+
+	hits := idx.search(query)
+	if len(hits) == 0 {
+		fmt.Fprintf(os.Stderr, "no matches\n")
+		return nil
+	}
+	if c.Limit > 0 && len(hits) > c.Limit {
+		hits = hits[:c.Limit]
+	}
+
+	hlBegin, hlEnd := "[", "]"
+	if isTerminal(os.Stdout) {
+		hlBegin, hlEnd = "\x1b[1;33m", "\x1b[0m"
+	}
+	hl := strings.NewReplacer("\x00", hlBegin, "\x01", hlEnd)
+
+	for _, h := range hits {
+		fmt.Printf("%v (%v)\n", h.Doc.Subject, h.Doc.Date.Format("2006-01-02 15:04"))
+		fmt.Printf("    %v\n", hl.Replace(h.Snippet))
+	}
+
+	return nil
+}
+
+// isTerminal reports whether f seems to be a terminal.
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return info.Mode()&os.ModeCharDevice != 0
+}
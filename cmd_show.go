@@ -1,25 +1,53 @@
 package main
 
+import "os"
+
 type showCmd struct {
 	All     bool   `help:"show all messages"`
 	Seq     string `help:"show by seq. (comma seprated or s1:s2)"`
 	Subject string `cli:"subject, subj"  help:"show by subject"`
+	Query   string `cli:"query=QUERY, q"  help:"show by query (e.g. \"subject:memo since:2024-01-01 not body:draft\")"`
 	Header  bool   `cli:"header, H"  help:"output mail headers"`
+	Format  string `cli:"format=FORMAT, f"  help:"output format (json, jsonl) including headers and bodies"`
+
+	Attachments string `cli:"attachments=DIR"  help:"save attachments (non-text parts) in DIR/SUBJECT/"`
+	Body        string `cli:"body=TYPE"  default:"plain"  help:"body of a message having both text/plain and text/html (plain, html)"`
+	RawHTML     bool   `cli:"raw-html"  help:"keep HTML bodies as they are instead of converting them into text"`
+
+	NoFrontMatter bool `cli:"no-front-matter"  help:"do not regenerate front matter of memos put with it"`
 }
 
 func (c showCmd) Run(g globalCmd) error {
-	config, err := loadConfig(g.Config)
+	config, err := g.loadConfig()
 	if err != nil {
 		return err
 	}
 	setAuthVariables(config)
 
+	body, err := normalizeBodyType(c.Body)
+	if err != nil {
+		return err
+	}
+
 	ic, err := initIMAP(config)
 	if err != nil {
 		return err
 	}
 
-	err = getMessages(ic, c.Header, c.All, c.Subject, c.Seq, g.Dir, "", stdoutWriter)
+	seq := c.Seq
+	if c.Query != "" {
+		if seq, err = resolveSeqByQuery(ic, c.Query); err != nil {
+			ic.Logout()
+			return err
+		}
+	}
+
+	if c.Format != "" {
+		err = writeMessagesJSON(ic, resolveSeq(ic, c.All, c.Subject, seq), c.Format, os.Stdout)
+	} else {
+		opts := getOptions{Body: body, Attachments: c.Attachments, RawHTML: c.RawHTML, FrontMatter: !c.NoFrontMatter}
+		err = getMessagesWithOptions(rootCtx, ic, c.Header, c.All, c.Subject, seq, g.Dir, "", opts, stdoutWriter)
+	}
 	ic.Logout()
 
 	return err
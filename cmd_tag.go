@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+type tagCmd struct {
+	Add tagAddCmd `help:"tag a message"`
+	Rm  tagRmCmd  `cli:"rm, remove"  help:"untag a message"`
+	Ls  tagLsCmd  `cli:"ls, list"  help:"list tags of a message, or all tags with counts"`
+}
+
+type tagAddCmd struct{}
+
+func (c tagAddCmd) Run(g globalCmd, args []string) error {
+	return runTagChange(g, args, true)
+}
+
+type tagRmCmd struct{}
+
+func (c tagRmCmd) Run(g globalCmd, args []string) error {
+	return runTagChange(g, args, false)
+}
+
+func runTagChange(g globalCmd, args []string, add bool) error {
+	if len(args) < 2 {
+		return fmt.Errorf("specify a subject and tags")
+	}
+	subject := args[0]
+
+	var tags []string
+	for _, arg := range args[1:] {
+		t, err := normalizeTag(arg)
+		if err != nil {
+			return err
+		}
+		tags = append(tags, t)
+	}
+
+	config, err := g.loadConfig()
+	if err != nil {
+		return err
+	}
+	setAuthVariables(config)
+
+	storage, err := tagStorageOf(config)
+	if err != nil {
+		return err
+	}
+
+	ic, err := initIMAP(config)
+	if err != nil {
+		return err
+	}
+	defer ic.Logout()
+
+	var result []string
+	if add {
+		result, err = changeTags(ic, config.IMAP.Box, subject, tags, nil, storage)
+	} else {
+		result, err = changeTags(ic, config.IMAP.Box, subject, nil, tags, storage)
+	}
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "%v: [%v]\n", subject, strings.Join(result, ", "))
+	return nil
+}
+
+type tagLsCmd struct{}
+
+func (c tagLsCmd) Run(g globalCmd, args []string) error {
+	if len(args) > 1 {
+		return fmt.Errorf("specify a subject or nothing")
+	}
+
+	config, err := g.loadConfig()
+	if err != nil {
+		return err
+	}
+	setAuthVariables(config)
+
+	ic, err := initIMAP(config)
+	if err != nil {
+		return err
+	}
+	defer ic.Logout()
+
+	tags, err := allTags(ic)
+	if err != nil {
+		return fmt.Errorf("failed to list tags: %v", err)
+	}
+
+	if len(args) == 1 {
+		seqs, err := memoSeqs(ic, args[0])
+		if err != nil {
+			return err
+		}
+		var memoTags []string
+		for _, seq := range seqs {
+			memoTags = mergeTags(memoTags, tags[seq], nil)
+		}
+		for _, t := range memoTags {
+			fmt.Println(t)
+		}
+		return nil
+	}
+
+	counts := make(map[string]int)
+	for _, ts := range tags {
+		for _, t := range ts {
+			counts[t]++
+		}
+	}
+	names := make([]string, 0, len(counts))
+	for t := range counts {
+		names = append(names, t)
+	}
+	sort.Strings(names)
+	for _, t := range names {
+		fmt.Printf("%v (%d)\n", t, counts[t])
+	}
+
+	return nil
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type exportedMemo struct {
+	Subject string
+	Ext     string
+	Time    time.Time
+	Body    string
+}
+
+// htmlExporter collects memos through its MsgWriter and renders them as a static site.
+type htmlExporter struct {
+	memos []exportedMemo
+	mu    sync.Mutex
+}
+
+func (e *htmlExporter) writer() MsgWriter {
+	return func(syncDirPath, subject, ext string, tm time.Time, r io.Reader) error {
+		data, err := ioutil.ReadAll(r)
+		if err != nil {
+			return fmt.Errorf("on subject[%v]: body reading error: %v", subject, err)
+		}
+		data = bytes.TrimPrefix(data, utf8BOM)
+
+		e.mu.Lock()
+		defer e.mu.Unlock()
+
+		e.memos = append(e.memos, exportedMemo{
+			Subject: subject,
+			Ext:     ext,
+			Time:    tm,
+			Body:    string(data),
+		})
+		return nil
+	}
+}
+
+type htmlPage struct {
+	File       string
+	Subject    string
+	Date       string
+	Markdown   bool
+	Text       string
+	HTML       template.HTML
+	SearchText string
+}
+
+// write renders a page per memo and index.html (newest first) into dir.
+func (e *htmlExporter) write(dir string) error {
+	sort.SliceStable(e.memos, func(i, j int) bool {
+		return e.memos[i].Time.After(e.memos[j].Time)
+	})
+
+	pages := make([]htmlPage, 0, len(e.memos))
+	for i, m := range e.memos {
+		p := htmlPage{
+			File:       fmt.Sprintf("%04d.html", i+1),
+			Subject:    m.Subject,
+			Date:       m.Time.Format("2006-01-02 15:04"),
+			Markdown:   strings.EqualFold(m.Ext, "md"),
+			Text:       strings.Replace(m.Body, "\r\n", "\n", -1),
+			SearchText: strings.ToLower(m.Subject + "\n" + m.Body),
+		}
+		if p.Markdown {
+			p.HTML = template.HTML(renderMarkdown(m.Body))
+		}
+
+		if err := writeHTMLFile(filepath.Join(dir, p.File), htmlPageTemplate, p); err != nil {
+			return err
+		}
+		pages = append(pages, p)
+	}
+
+	return writeHTMLFile(filepath.Join(dir, "index.html"), htmlIndexTemplate, pages)
+}
+
+func writeHTMLFile(name string, tmpl *template.Template, data interface{}) error {
+	buff := new(bytes.Buffer)
+	if err := tmpl.Execute(buff, data); err != nil {
+		return fmt.Errorf("failed to render %q: %v", name, err)
+	}
+	if err := ioutil.WriteFile(name, buff.Bytes(), 0644); err != nil {
+		return fmt.Errorf("failed to write to %q: %v", name, err)
+	}
+	return nil
+}
+
+const htmlStyle = `
+body { font-family: sans-serif; margin: 0 auto; max-width: 48em; padding: 0.5em 1em; line-height: 1.6; }
+pre { white-space: pre-wrap; word-wrap: break-word; }
+pre code, .md pre { background: #f4f4f4; display: block; padding: 0.5em; }
+blockquote { border-left: 3px solid #ccc; margin-left: 0; padding-left: 1em; color: #555; }
+.date { color: #888; font-size: small; }
+#q { box-sizing: border-box; font-size: large; width: 100%; }
+#list { list-style: none; padding: 0; }
+#list li { border-bottom: solid thin #eee; padding: 0.4em 0; }
+`
+
+var htmlPageTemplate = template.Must(template.New("page").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Subject}}</title>
+<style>` + htmlStyle + `</style>
+</head>
+<body>
+<p><a href="index.html">&larr; index</a></p>
+<h1>{{.Subject}}</h1>
+<p class="date">{{.Date}}</p>
+{{if .Markdown}}<div class="md">
+{{.HTML}}</div>{{else}}<pre>{{.Text}}</pre>{{end}}
+</body>
+</html>
+`))
+
+var htmlIndexTemplate = template.Must(template.New("index").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>pomi</title>
+<style>` + htmlStyle + `</style>
+</head>
+<body>
+<input id="q" type="search" placeholder="search" autofocus>
+<ul id="list">
+{{range .}}<li data-text="{{.SearchText}}"><a href="{{.File}}">{{.Subject}}</a> <span class="date">{{.Date}}</span></li>
+{{end}}</ul>
+<script>
+document.getElementById("q").addEventListener("input", function() {
+	var words = this.value.toLowerCase().split(/\s+/);
+	var items = document.querySelectorAll("#list li");
+	for (var i = 0; i < items.length; i++) {
+		var text = items[i].getAttribute("data-text");
+		var hit = true;
+		for (var j = 0; j < words.length; j++) {
+			if (words[j] !== "" && text.indexOf(words[j]) === -1) {
+				hit = false;
+				break;
+			}
+		}
+		items[i].style.display = hit ? "" : "none";
+	}
+});
+</script>
+</body>
+</html>
+`))
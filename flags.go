@@ -0,0 +1,59 @@
+package main
+
+import "fmt"
+
+// System flags pomi changes.
+const (
+	flagSeen    = `\Seen`
+	flagFlagged = `\Flagged` // pinned
+)
+
+// storeFlag adds flag to messages in seqset, or removes it if add is false.
+func storeFlag(c *imapConn, seqset, flag string, add bool) error {
+	item := "+FLAGS"
+	if !add {
+		item = "-FLAGS"
+	}
+	logTrace("imap", "cmd", "STORE "+item+" "+flag, "seqset", seqset)
+	if err := c.Store(seqset, item, []string{flag}); err != nil {
+		return fmt.Errorf("failed to set %v: %v", flag, err)
+	}
+	return nil
+}
+
+// carriedFlags returns \Seen, \Flagged and known keywords on the newest of found,
+// to be set on the message replacing it.
+func carriedFlags(c *imapConn, found []foundMessage) []string {
+	if len(found) == 0 {
+		return nil
+	}
+	newest := found[len(found)-1].Seq
+
+	var flags []string
+	for _, f := range []struct{ key, flag string }{{"SEEN", flagSeen}, {"FLAGGED", flagFlagged}} {
+		seqs, err := c.Search(f.key)
+		if err != nil {
+			logDebug("flag search", "key", f.key, "err", err)
+			continue
+		}
+		for _, seq := range seqs {
+			if seq == newest {
+				flags = append(flags, f.flag)
+				break
+			}
+		}
+	}
+	return append(flags, carriedKeywords(c, found)...)
+}
+
+// flagLabels returns the states of flags shown in the text of pomi list.
+//
+// Read states are left out: memos put by pomi are all unread until read on a device,
+// so "unread" would be on almost every line. is:unread finds them instead.
+func flagLabels(flags []string) []string {
+	var labels []string
+	if containsString(flags, flagFlagged) {
+		labels = append(labels, "pinned")
+	}
+	return labels
+}
@@ -0,0 +1,400 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"mime"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Headers of a memo put from a file with front matter.
+const (
+	frontMatterHeader = "X-Pomi-Front-Matter" // the keys in order, comma separated
+	metaHeaderPrefix  = "X-Pomi-Meta-"        // followed by a key: its value as written
+)
+
+// frontMatter is the YAML-style block at the top of a file:
+//
+//	---
+//	title: Meeting notes
+//	date: 2024-06-03 10:00
+//	tags: [work, 会議]
+//	author: me
+//	---
+//
+// Only "key: scalar", "key: [a, b]" and "key:" followed by "- item" lines are supported.
+type frontMatter struct {
+	Keys   []string          // as written
+	Values map[string]string // raw values by key; lists are in the flow style
+
+	Title   string
+	Tags    []string
+	HasTags bool
+	Date    time.Time // zero if none or unparsable
+}
+
+var frontMatterKeyPattern = regexp.MustCompile(`^([A-Za-z0-9_][A-Za-z0-9_.-]*)\s*:(?:\s+(.*))?$`)
+
+// parseFrontMatter splits data (UTF-8, maybe with BOM) into its front matter and the rest.
+// fm is nil if data has no front matter. An error is returned if it has but can't be parsed.
+func parseFrontMatter(data []byte) (fm *frontMatter, body []byte, err error) {
+	hasBOM := bytes.HasPrefix(data, utf8BOM)
+	rest := bytes.TrimPrefix(data, utf8BOM)
+
+	lines := bytes.SplitAfter(rest, []byte("\n"))
+	if len(lines) < 2 || trimEOL(lines[0]) != "---" {
+		return nil, data, nil
+	}
+
+	end := -1
+	for i := 1; i < len(lines); i++ {
+		if l := trimEOL(lines[i]); l == "---" || l == "..." {
+			end = i
+			break
+		}
+	}
+	if end == -1 {
+		return nil, data, nil
+	}
+
+	fm = &frontMatter{Values: make(map[string]string)}
+	var listKey string
+	var items []string
+	flush := func() {
+		if listKey != "" {
+			fm.Values[listKey] = "[" + strings.Join(items, ", ") + "]"
+			listKey, items = "", nil
+		}
+	}
+
+	for i := 1; i < end; i++ {
+		l := trimEOL(lines[i])
+		trimmed := strings.TrimSpace(l)
+		switch {
+		case trimmed == "" || strings.HasPrefix(trimmed, "#"):
+			continue
+
+		case strings.HasPrefix(trimmed, "- ") || trimmed == "-":
+			if listKey == "" {
+				return nil, data, fmt.Errorf("front matter line %d: an item out of a list", i+1)
+			}
+			items = append(items, strings.TrimSpace(strings.TrimPrefix(trimmed, "-")))
+
+		default:
+			m := frontMatterKeyPattern.FindStringSubmatch(l)
+			if m == nil {
+				return nil, data, fmt.Errorf("front matter line %d: unsupported %q", i+1, l)
+			}
+			flush()
+
+			key, value := m[1], strings.TrimSpace(m[2])
+			if _, dup := fm.Values[key]; dup {
+				return nil, data, fmt.Errorf("front matter line %d: duplicate key %q", i+1, key)
+			}
+			if value == "|" || value == ">" || strings.HasPrefix(value, "{") {
+				return nil, data, fmt.Errorf("front matter line %d: unsupported value of %q", i+1, key)
+			}
+			fm.Keys = append(fm.Keys, key)
+			fm.Values[key] = value
+			if value == "" {
+				listKey = key
+			}
+		}
+	}
+	flush()
+	if len(fm.Keys) == 0 {
+		// nothing to keep in headers, so left in the body
+		return nil, data, nil
+	}
+
+	for _, key := range fm.Keys {
+		value := fm.Values[key]
+		switch strings.ToLower(key) {
+		case "title":
+			fm.Title = unquoteYAML(value)
+		case "tags":
+			for _, t := range parseYAMLList(value) {
+				t, err := normalizeTag(t)
+				if err != nil {
+					return nil, data, fmt.Errorf("front matter: %v", err)
+				}
+				fm.Tags = append(fm.Tags, t)
+			}
+			fm.HasTags = true
+		case "date":
+			fm.Date, _ = parseFrontMatterDate(unquoteYAML(value))
+		}
+	}
+
+	body = bytes.Join(lines[end+1:], nil)
+	if hasBOM {
+		body = append(append([]byte(nil), utf8BOM...), body...)
+	}
+	return fm, body, nil
+}
+
+func trimEOL(line []byte) string {
+	return strings.TrimRight(string(line), "\r\n")
+}
+
+var frontMatterDateLayouts = []string{
+	time.RFC3339,
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05 -0700",
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04",
+	"2006-01-02",
+	"2006/01/02 15:04:05",
+	"2006/01/02 15:04",
+	"2006/01/02",
+}
+
+// parseFrontMatterDate parses a date in the local time unless it has an offset.
+func parseFrontMatterDate(s string) (time.Time, error) {
+	for _, layout := range frontMatterDateLayouts {
+		if tm, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return tm, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("unsupported date %q", s)
+}
+
+func unquoteYAML(s string) string {
+	switch {
+	case len(s) >= 2 && s[0] == '"' && s[len(s)-1] == '"':
+		if u, err := strconv.Unquote(s); err == nil {
+			return u
+		}
+		return s[1 : len(s)-1]
+	case len(s) >= 2 && s[0] == '\'' && s[len(s)-1] == '\'':
+		return strings.Replace(s[1:len(s)-1], "''", "'", -1)
+	}
+	return s
+}
+
+// quoteYAML quotes s if it is not safe as a plain scalar.
+func quoteYAML(s string) string {
+	if s == "" || s != strings.TrimSpace(s) || strings.ContainsAny(s[:1], "-?:,[]{}#&*!|>'\"%@`") ||
+		strings.Contains(s, ": ") || strings.Contains(s, " #") || strings.ContainsAny(s, ",[]") {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+// parseYAMLList parses "[a, b]" or a single scalar.
+func parseYAMLList(s string) []string {
+	if strings.HasPrefix(s, "[") && strings.HasSuffix(s, "]") {
+		s = s[1 : len(s)-1]
+	}
+
+	var items []string
+	for _, item := range splitYAMLFlow(s) {
+		if item = unquoteYAML(strings.TrimSpace(item)); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// splitYAMLFlow splits s by commas out of quotes.
+func splitYAMLFlow(s string) []string {
+	var items []string
+	var quote rune
+	start := 0
+	for i, r := range s {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case r == '"' || r == '\'':
+			quote = r
+		case r == ',':
+			items = append(items, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(items, s[start:])
+}
+
+func formatYAMLList(items []string) string {
+	quoted := make([]string, len(items))
+	for i, item := range items {
+		quoted[i] = quoteYAML(item)
+	}
+	return "[" + strings.Join(quoted, ", ") + "]"
+}
+
+// encodeHeader encodes a header value in RFC 2047 if it is not ASCII.
+func encodeHeader(v string) string {
+	for _, r := range v {
+		if r >= 0x80 {
+			return mime.BEncoding.Encode("utf-8", v)
+		}
+	}
+	return v
+}
+
+func decodeHeader(v string) string {
+	if decoded, err := mimeWordDecoder.DecodeHeader(v); err == nil {
+		return decoded
+	}
+	return v
+}
+
+func metaHeader(key string) string {
+	return textproto.CanonicalMIMEHeaderKey(metaHeaderPrefix + key)
+}
+
+// headers returns the headers the front matter maps to.
+// title is not included because it is the Subject. date is kept as written besides the Date.
+func (fm *frontMatter) headers() mail.Header {
+	h := mail.Header{frontMatterHeader: []string{strings.Join(fm.Keys, ", ")}}
+	if fm.HasTags {
+		h[tagsHeader] = []string{formatTagsHeader(mergeTags(fm.Tags, nil, nil))}
+	}
+	for _, key := range fm.Keys {
+		switch strings.ToLower(key) {
+		case "title", "tags":
+		default:
+			h[metaHeader(key)] = []string{encodeHeader(fm.Values[key])}
+		}
+	}
+	return h
+}
+
+// applyFrontMatter strips the front matter off data of a file name,
+// and returns the subject, the time and the headers it specifies.
+// If data has no front matter or a broken one, it returns them as they are.
+func applyFrontMatter(name, subject string, tm time.Time, data []byte) (string, time.Time, []byte, mail.Header) {
+	fm, body, err := parseFrontMatter(data)
+	if err != nil {
+		logWarn("front matter", "file", name, "err", err)
+		fmt.Fprintf(os.Stderr, "%v: %v, put as is\n", name, err)
+		return subject, tm, data, nil
+	}
+	if fm == nil {
+		return subject, tm, data, nil
+	}
+
+	if fm.Title != "" {
+		subject = fm.Title
+	}
+	if !fm.Date.IsZero() {
+		tm = fm.Date
+	}
+	logDebug("front matter", "file", name, "subject", subject, "keys", fm.Keys)
+	return subject, tm, body, fm.headers()
+}
+
+// isFrontMatterHeader reports whether key is a header managed by front matter (except tagsHeader).
+func isFrontMatterHeader(key string) bool {
+	key = textproto.CanonicalMIMEHeaderKey(key)
+	return key == frontMatterHeader || strings.HasPrefix(key, metaHeaderPrefix)
+}
+
+// renderFrontMatter regenerates the front matter of a memo from its headers, with the line ending nl.
+// It returns "" if the memo was not put with front matter.
+func renderFrontMatter(h mail.Header, nl string) string {
+	keysValue := h.Get(frontMatterHeader)
+	if keysValue == "" {
+		return ""
+	}
+
+	lines := []string{"---"}
+	hasTags := false
+	for _, key := range strings.Split(keysValue, ",") {
+		key = strings.TrimSpace(key)
+		if key == "" {
+			continue
+		}
+		if strings.ToLower(key) == "tags" {
+			hasTags = true
+		}
+
+		var value string
+		switch strings.ToLower(key) {
+		case "title":
+			value = quoteYAML(decodeHeader(h.Get("Subject")))
+		case "tags":
+			value = formatYAMLList(parseTagsHeader(h.Get(tagsHeader)))
+		case "date":
+			value = renderFrontMatterDate(decodeHeader(h.Get(metaHeader(key))), h.Get("Date"))
+		default:
+			value = decodeHeader(h.Get(metaHeader(key)))
+		}
+
+		if value == "" {
+			lines = append(lines, key+":")
+		} else {
+			lines = append(lines, key+": "+value)
+		}
+	}
+	if tags := parseTagsHeader(h.Get(tagsHeader)); !hasTags && len(tags) > 0 {
+		// tagged by pomi tag
+		lines = append(lines, "tags: "+formatYAMLList(tags))
+	}
+	lines = append(lines, "---")
+
+	return strings.Join(lines, nl) + nl
+}
+
+// renderFrontMatterDate returns raw as written if the Date header is still the time of it,
+// otherwise the Date header in a similar format.
+func renderFrontMatterDate(raw, date string) string {
+	tm, err := mail.ParseDate(date)
+	if err != nil {
+		return raw
+	}
+	if rawTime, err := parseFrontMatterDate(unquoteYAML(raw)); err == nil && rawTime.Equal(tm) {
+		return raw
+	}
+
+	tm = tm.In(time.Local)
+	if len(unquoteYAML(raw)) == len("2006-01-02") {
+		return tm.Format("2006-01-02")
+	}
+	return tm.Format(time.RFC3339)
+}
+
+// withFrontMatter puts the front matter regenerated from the headers of msg at the top of its body.
+func withFrontMatter(msg *mail.Message) error {
+	if msg.Header.Get(frontMatterHeader) == "" {
+		return nil
+	}
+
+	body, err := readAllBody(msg)
+	if err != nil {
+		return err
+	}
+
+	nl := "\n"
+	if bytes.Contains(body, []byte("\r\n")) {
+		nl = "\r\n"
+	}
+	fm := []byte(renderFrontMatter(msg.Header, nl))
+
+	buff := new(bytes.Buffer)
+	if bytes.HasPrefix(body, utf8BOM) {
+		buff.Write(utf8BOM)
+		body = body[len(utf8BOM):]
+	}
+	buff.Write(fm)
+	buff.Write(body)
+	msg.Body = buff
+	return nil
+}
+
+func readAllBody(msg *mail.Message) ([]byte, error) {
+	buff := new(bytes.Buffer)
+	if _, err := buff.ReadFrom(msg.Body); err != nil {
+		return nil, fmt.Errorf("on subject[%v]: body reading error: %v", msg.Header.Get("Subject"), err)
+	}
+	return buff.Bytes(), nil
+}
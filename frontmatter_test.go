@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/mail"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseFrontMatter(t *testing.T) {
+	data := "\ufeff---\r\n" +
+		"title: \"Meeting: notes\"\r\n" +
+		"date: 2024-06-03 10:00\r\n" +
+		"# a comment\r\n" +
+		"tags:\r\n" +
+		"  - work\r\n" +
+		"  - '会議'\r\n" +
+		"author: me\r\n" +
+		"---\r\n" +
+		"\r\n" +
+		"body\r\n"
+
+	fm, body, err := parseFrontMatter([]byte(data))
+	if err != nil || fm == nil {
+		t.Fatalf("parseFrontMatter = %v, %v", fm, err)
+	}
+	if string(body) != "\ufeff\r\nbody\r\n" {
+		t.Errorf("body = %q", body)
+	}
+	if strings.Join(fm.Keys, ",") != "title,date,tags,author" {
+		t.Errorf("keys = %q", fm.Keys)
+	}
+	if fm.Title != "Meeting: notes" {
+		t.Errorf("title = %q", fm.Title)
+	}
+	if !fm.HasTags || strings.Join(fm.Tags, ",") != "work,会議" {
+		t.Errorf("tags = %q", fm.Tags)
+	}
+	if want := time.Date(2024, 6, 3, 10, 0, 0, 0, time.Local); !fm.Date.Equal(want) {
+		t.Errorf("date = %v", fm.Date)
+	}
+
+	h := fm.headers()
+	if h.Get(frontMatterHeader) != "title, date, tags, author" ||
+		h.Get("X-Pomi-Meta-Author") != "me" || h.Get("X-Pomi-Meta-Date") != "2024-06-03 10:00" ||
+		parseTagsHeader(h.Get(tagsHeader))[1] != "会議" || h.Get("X-Pomi-Meta-Title") != "" {
+		t.Errorf("headers = %v", h)
+	}
+
+	for _, data := range []string{"no front matter\n", "---\nnot closed\n", "---", "text\n---\na: b\n---\n", "---\n---\nbody\n", "---\n# only a comment\n---\n"} {
+		fm, body, err := parseFrontMatter([]byte(data))
+		if fm != nil || err != nil || string(body) != data {
+			t.Errorf("%q: %v, %q, %v", data, fm, body, err)
+		}
+	}
+
+	for _, data := range []string{"---\njust a line\n---\n", "---\n- item\n---\n", "---\na: 1\na: 2\n---\n", "---\na: |\n  text\n---\n", "---\ntags: [\"a, b\"]\n---\n"} {
+		if _, body, err := parseFrontMatter([]byte(data)); err == nil || string(body) != data {
+			t.Errorf("%q must fail", data)
+		}
+	}
+}
+
+func TestFrontMatterRoundTrip(t *testing.T) {
+	data := "---\ntitle: 議事録\ntags: [work, \"会議\"]\ndate: 2024-06-03\nauthor: \"me\"\n---\nbody\n"
+
+	subject, tm, body, extra := applyFrontMatter("f.md", "f", time.Time{}, []byte(data))
+	if subject != "議事録" || string(body) != "body\n" {
+		t.Fatalf("applyFrontMatter = %q, %q", subject, body)
+	}
+
+	h := mail.Header{
+		"Subject": []string{subject},
+		"Date":    []string{tm.Format(time.RFC1123Z)},
+	}
+	for k, v := range extra {
+		h[k] = v
+	}
+	msg := &mail.Message{Header: h, Body: bytes.NewReader(append([]byte("\ufeff"), body...))}
+	if err := withFrontMatter(msg); err != nil {
+		t.Fatal(err)
+	}
+	got, _ := ioutil.ReadAll(msg.Body)
+	want := "\ufeff---\ntitle: 議事録\ntags: [work, 会議]\ndate: 2024-06-03\nauthor: \"me\"\n---\nbody\n"
+	if string(got) != want {
+		t.Errorf("got %q\nwant %q", got, want)
+	}
+
+	// changed on the device, or tagged by pomi tag
+	h["Date"] = []string{time.Date(2024, 6, 4, 0, 0, 0, 0, time.Local).Format(time.RFC1123Z)}
+	h[frontMatterHeader] = []string{"title, date"}
+	if got, want := renderFrontMatter(h, "\r\n"), "---\r\ntitle: 議事録\r\ndate: 2024-06-04\r\ntags: [work, 会議]\r\n---\r\n"; got != want {
+		t.Errorf("got %q\nwant %q", got, want)
+	}
+
+	// not put with front matter
+	msg = &mail.Message{Header: mail.Header{"Subject": []string{"s"}}, Body: strings.NewReader("body")}
+	if err := withFrontMatter(msg); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := ioutil.ReadAll(msg.Body); string(got) != "body" {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestSamePomiHeaders(t *testing.T) {
+	a := mail.Header{"X-Pomi-Ext": []string{"md"}, tagsHeader: []string{formatTagsHeader([]string{"会議"})}, "Date": []string{"x"}}
+	b := mail.Header{"X-Pomi-Ext": []string{"md"}, tagsHeader: []string{"会議"}}
+	if !samePomiHeaders(a, b) {
+		t.Errorf("must be the same")
+	}
+	b["X-Pomi-Meta-Author"] = []string{"me"}
+	if samePomiHeaders(a, b) {
+		t.Errorf("must differ")
+	}
+}
+
+func TestPutMessageKeepsFrontMatter(t *testing.T) {
+	_, tm, body, extra := applyFrontMatter("f.md", "f", time.Time{}, []byte("---\ntitle: f\nauthor: me\n---\nbody\n"))
+	h := mail.Header{"Subject": []string{"f"}, "Date": []string{tm.Format(time.RFC1123Z)}}
+	for k, v := range extra {
+		h[k] = v
+	}
+	found := []foundMessage{{Seq: 1, Msg: &mail.Message{Header: h}, Body: body}}
+
+	now := time.Date(2024, 6, 4, 0, 0, 0, 0, time.Local)
+	for name, data := range map[string]string{
+		"edit":   "edited\n",
+		"append": appendText(string(body), "appended", ""),
+	} {
+		// putMessage by edit and append
+		m := newPutMessage(found, "me", "f", "md", nil, false, now)
+		m.Body = strings.NewReader(data)
+		if err := withFrontMatter(m); err != nil {
+			t.Fatal(err)
+		}
+		got, _ := ioutil.ReadAll(m.Body)
+		if want := "---\ntitle: f\nauthor: me\n---\n" + data; string(got) != want {
+			t.Errorf("%v: got %q\nwant %q", name, got, want)
+		}
+	}
+	if h.Get("Date") != tm.Format(time.RFC1123Z) {
+		t.Errorf("the found message must not be changed")
+	}
+
+	// put from a file without front matter any more
+	m := newPutMessage(found, "me", "f", "md", nil, true, now)
+	if m.Header.Get(frontMatterHeader) != "" || m.Header.Get("X-Pomi-Meta-Author") != "" {
+		t.Errorf("front matter headers must be removed: %v", m.Header)
+	}
+}
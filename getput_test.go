@@ -1,10 +1,14 @@
 package main
 
 import (
+	"context"
+	"io"
 	"io/ioutil"
 	"path/filepath"
 	"sort"
+	"strconv"
 	"testing"
+	"time"
 )
 
 func TestPutAndListAndGet(t *testing.T) {
@@ -138,3 +142,26 @@ func TestPutAndListAndGet(t *testing.T) {
 	ic.Logout()
 	teardownLocal(t)
 }
+
+func TestGetMessagesByUID(t *testing.T) {
+	msg := "Subject: a\r\nDate: Mon, 03 Jun 2024 10:00:00 +0900\r\nContent-Type: text/plain; charset=utf-8\r\n\r\nbody\r\n"
+	c := startFakeIMAP(t, time.Second, []fakeIMAPStep{
+		{Command: "UID SEARCH 2:3", Reply: []string{"* SEARCH 12 10", "TAG OK done"}},
+		{
+			Command: "UID FETCH 10 (UID FLAGS BODY.PEEK[])",
+			Reply:   []string{"* 2 FETCH (UID 10 FLAGS () BODY[] {" + strconv.Itoa(len(msg)) + "}\r\n" + msg + ")", "TAG OK done"},
+		},
+		// expunged by another client
+		{Command: "UID FETCH 12 (UID FLAGS BODY.PEEK[])", Reply: []string{"TAG OK done"}},
+	})
+
+	var got []string
+	w := func(syncDirPath, subject, ext string, tm time.Time, r io.Reader) error {
+		got = append(got, subject)
+		return nil
+	}
+	err := getMessagesWithOptions(context.Background(), c, false, false, "", "2:3", ".", "txt", getOptions{BatchSize: 1}, w)
+	if err != nil || len(got) != 1 || got[0] != "a" {
+		t.Errorf("got %v, %v", got, err)
+	}
+}
@@ -7,5 +7,5 @@ require (
 	github.com/pkg/browser v0.0.0-20180916011732-0a3d74bf9ce4
 	github.com/shu-go/gli v0.0.0-20200220142448-5ad1f294aff4
 	github.com/shu-go/imapclient v0.0.0-20180718013840-8d2d1c170805
-	golang.org/x/text v0.3.2 // indirect
+	golang.org/x/text v0.3.2
 )
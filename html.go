@@ -0,0 +1,430 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"strings"
+	"unicode"
+)
+
+// htmlToText converts an HTML document into plain text.
+//
+// Paragraphs and headings are separated by blank lines, list items get "- " or "1. ",
+// block quotes get "> ", and links are numbered like "text[1]" with the URLs listed at the end.
+func htmlToText(s string) string {
+	w := &htmlTextWriter{}
+	s = strings.Replace(s, "\r\n", "\n", -1)
+
+	for len(s) > 0 {
+		i := strings.IndexByte(s, '<')
+		if i == -1 {
+			w.text(html.UnescapeString(s))
+			break
+		}
+		if i > 0 {
+			w.text(html.UnescapeString(s[:i]))
+			s = s[i:]
+		}
+
+		switch {
+		case strings.HasPrefix(s, "<!--"):
+			end := strings.Index(s[4:], "-->")
+			if end == -1 {
+				s = ""
+			} else {
+				s = s[4+end+3:]
+			}
+
+		case len(s) > 1 && (s[1] == '!' || s[1] == '?'):
+			// doctype, processing instruction
+			end := strings.IndexByte(s, '>')
+			if end == -1 {
+				s = ""
+			} else {
+				s = s[end+1:]
+			}
+
+		case len(s) > 1 && (s[1] == '/' || isASCIILetter(s[1])):
+			t, rest := parseHTMLTag(s)
+			s = rest
+			if !t.closing && (t.name == "script" || t.name == "style") {
+				// raw text up to the end tag
+				end := strings.Index(strings.ToLower(s), "</"+t.name)
+				if end == -1 {
+					s = ""
+				} else {
+					s = s[end:]
+				}
+				continue
+			}
+			w.tag(t)
+
+		default:
+			w.text("<")
+			s = s[1:]
+		}
+	}
+
+	return w.String()
+}
+
+type htmlTag struct {
+	name        string // lower case
+	closing     bool
+	selfClosing bool
+	attrs       map[string]string
+}
+
+// parseHTMLTag parses a tag at the start of s and returns it and the rest of s.
+func parseHTMLTag(s string) (htmlTag, string) {
+	t := htmlTag{attrs: make(map[string]string)}
+
+	i := 1
+	if s[i] == '/' {
+		t.closing = true
+		i++
+	}
+	start := i
+	for i < len(s) && !isHTMLSpace(s[i]) && s[i] != '/' && s[i] != '>' {
+		i++
+	}
+	t.name = strings.ToLower(s[start:i])
+
+	for i < len(s) {
+		for i < len(s) && isHTMLSpace(s[i]) {
+			i++
+		}
+		if i >= len(s) {
+			break
+		}
+		if s[i] == '>' {
+			return t, s[i+1:]
+		}
+		if s[i] == '/' {
+			t.selfClosing = true
+			i++
+			continue
+		}
+
+		start := i
+		for i < len(s) && !isHTMLSpace(s[i]) && s[i] != '=' && s[i] != '>' && s[i] != '/' {
+			i++
+		}
+		name := strings.ToLower(s[start:i])
+		for i < len(s) && isHTMLSpace(s[i]) {
+			i++
+		}
+		if i >= len(s) || s[i] != '=' {
+			t.attrs[name] = ""
+			continue
+		}
+		i++
+		for i < len(s) && isHTMLSpace(s[i]) {
+			i++
+		}
+
+		var value string
+		if i < len(s) && (s[i] == '"' || s[i] == '\'') {
+			q := s[i]
+			end := strings.IndexByte(s[i+1:], q)
+			if end == -1 {
+				value, i = s[i+1:], len(s)
+			} else {
+				value, i = s[i+1:i+1+end], i+1+end+1
+			}
+		} else {
+			start := i
+			for i < len(s) && !isHTMLSpace(s[i]) && s[i] != '>' {
+				i++
+			}
+			value = s[start:i]
+		}
+		t.attrs[name] = html.UnescapeString(value)
+	}
+
+	// not closed
+	return t, ""
+}
+
+func isHTMLSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f'
+}
+
+func isASCIILetter(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z'
+}
+
+type htmlList struct {
+	ordered bool
+	n       int
+}
+
+type htmlLink struct {
+	href  string
+	start int // position in buf where the link text starts
+}
+
+// htmlTextWriter renders the text of HTML elements.
+type htmlTextWriter struct {
+	buf         strings.Builder
+	newlines    int  // trailing newlines in buf
+	lineStarted bool // the prefix of the current line is written
+	space       bool // a space is pending
+	spaced      bool // buf ends with a space
+
+	skip  int // in elements not shown
+	pre   int
+	quote int
+	cells int // cells written in the current row
+
+	lists []htmlList
+	links []htmlLink
+	notes []string // URLs of footnotes
+}
+
+func (w *htmlTextWriter) String() string {
+	s := strings.TrimRight(w.buf.String(), " \t\n")
+	if s == "" && len(w.notes) == 0 {
+		return ""
+	}
+	s += "\n"
+
+	if len(w.notes) > 0 {
+		s += "\n"
+		for i, href := range w.notes {
+			s += fmt.Sprintf("[%d] %v\n", i+1, href)
+		}
+	}
+	return s
+}
+
+// startLine writes the prefix of the line if it is not yet.
+func (w *htmlTextWriter) startLine() {
+	if w.lineStarted {
+		return
+	}
+	w.lineStarted = true
+	if w.quote > 0 {
+		w.buf.WriteString(strings.Repeat("> ", w.quote))
+	}
+}
+
+func (w *htmlTextWriter) write(s string) {
+	if s == "" {
+		return
+	}
+	if w.space && !w.spaced {
+		w.buf.WriteByte(' ')
+	}
+	w.space = false
+	w.startLine()
+	w.buf.WriteString(s)
+	w.newlines = 0
+	w.spaced = strings.HasSuffix(s, " ") || strings.HasSuffix(s, "\t")
+}
+
+func (w *htmlTextWriter) text(s string) {
+	if w.skip > 0 {
+		return
+	}
+
+	if w.pre > 0 {
+		for _, line := range strings.SplitAfter(s, "\n") {
+			if strings.HasSuffix(line, "\n") {
+				w.write(strings.TrimSuffix(line, "\n"))
+				w.newline()
+			} else {
+				w.write(line)
+			}
+		}
+		return
+	}
+
+	var word strings.Builder
+	for _, r := range s {
+		if r == '\u00a0' {
+			// &nbsp; is not collapsed
+			word.WriteByte(' ')
+			continue
+		}
+		if unicode.IsSpace(r) {
+			w.write(word.String())
+			word.Reset()
+			if w.lineStarted && w.newlines == 0 {
+				w.space = true
+			}
+			continue
+		}
+		word.WriteRune(r)
+	}
+	w.write(word.String())
+}
+
+// newline ends the current line, even if it is empty.
+func (w *htmlTextWriter) newline() {
+	if w.buf.Len() == 0 {
+		return
+	}
+	w.space = false
+	w.buf.WriteByte('\n')
+	w.newlines++
+	w.lineStarted = false
+}
+
+// breakLine ends the current line so that there are n newlines (2 for a blank line).
+func (w *htmlTextWriter) breakLine(n int) {
+	if w.buf.Len() == 0 {
+		return
+	}
+	w.space = false
+	for w.newlines < n {
+		w.newline()
+	}
+}
+
+func (w *htmlTextWriter) tag(t htmlTag) {
+	switch t.name {
+	case "head", "title", "template", "noframes":
+		if t.closing {
+			if w.skip > 0 {
+				w.skip--
+			}
+		} else if !t.selfClosing {
+			w.skip++
+		}
+		return
+	}
+	if w.skip > 0 {
+		return
+	}
+
+	switch t.name {
+	case "br":
+		w.newline()
+
+	case "p", "h1", "h2", "h3", "h4", "h5", "h6", "table", "dl", "figure":
+		w.breakLine(2)
+
+	case "pre":
+		w.breakLine(2)
+		if t.closing {
+			if w.pre > 0 {
+				w.pre--
+			}
+		} else {
+			w.pre++
+		}
+
+	case "blockquote":
+		w.breakLine(2)
+		if t.closing {
+			if w.quote > 0 {
+				w.quote--
+			}
+		} else {
+			w.quote++
+		}
+
+	case "hr":
+		w.breakLine(2)
+		w.write("----")
+		w.breakLine(2)
+
+	case "div", "section", "article", "header", "footer", "nav", "aside", "main", "address", "caption", "dt", "dd":
+		w.breakLine(1)
+
+	case "tr":
+		w.breakLine(1)
+		w.cells = 0
+
+	case "td", "th":
+		if !t.closing {
+			if w.cells > 0 {
+				w.space = false
+				w.write("\t")
+			}
+			w.cells++
+		}
+
+	case "ul", "ol":
+		if t.closing && len(w.lists) > 0 {
+			w.lists = w.lists[:len(w.lists)-1]
+		}
+		if len(w.lists) == 0 {
+			w.breakLine(2)
+		} else {
+			w.breakLine(1)
+		}
+		if !t.closing {
+			w.lists = append(w.lists, htmlList{ordered: t.name == "ol"})
+		}
+
+	case "li":
+		w.breakLine(1)
+		if t.closing {
+			return
+		}
+		marker := "- "
+		indent := ""
+		if len(w.lists) > 0 {
+			l := &w.lists[len(w.lists)-1]
+			if l.ordered {
+				l.n++
+				marker = fmt.Sprintf("%d. ", l.n)
+			}
+			indent = strings.Repeat("  ", len(w.lists)-1)
+		}
+		w.write(indent + marker)
+
+	case "img":
+		if alt := strings.TrimSpace(t.attrs["alt"]); alt != "" {
+			w.text(alt)
+		}
+
+	case "a":
+		if !t.closing {
+			if !t.selfClosing {
+				w.links = append(w.links, htmlLink{href: strings.TrimSpace(t.attrs["href"]), start: w.buf.Len()})
+			}
+			return
+		}
+		if len(w.links) == 0 {
+			return
+		}
+		l := w.links[len(w.links)-1]
+		w.links = w.links[:len(w.links)-1]
+		w.footnote(l)
+	}
+}
+
+// footnote refers the URL of a link just closed, unless the text is the URL itself.
+func (w *htmlTextWriter) footnote(l htmlLink) {
+	href := l.href
+	lower := strings.ToLower(href)
+	if href == "" || strings.HasPrefix(href, "#") || strings.HasPrefix(lower, "javascript:") {
+		return
+	}
+
+	text := ""
+	if l.start <= w.buf.Len() {
+		text = strings.TrimSpace(w.buf.String()[l.start:])
+	}
+	if text == href || "mailto:"+text == lower || strings.TrimSuffix(href, "/") == text {
+		return
+	}
+
+	n := 0
+	for i, note := range w.notes {
+		if note == href {
+			n = i + 1
+			break
+		}
+	}
+	if n == 0 {
+		w.notes = append(w.notes, href)
+		n = len(w.notes)
+	}
+
+	w.space = false
+	w.write(fmt.Sprintf("[%d]", n))
+}
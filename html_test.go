@@ -0,0 +1,42 @@
+package main
+
+import "testing"
+
+func TestHTMLToText(t *testing.T) {
+	cases := []struct {
+		html string
+		text string
+	}{
+		{"", ""},
+		{"plain &amp; simple", "plain & simple\n"},
+		{
+			"<!DOCTYPE html><html><head><title>t</title><style>p { color: red; }</style></head>\r\n" +
+				"<body><h1>Title</h1><p>first\r\n  paragraph<br>next&nbsp;&nbsp;line</p><p>second &lt;p&gt; &#x3042;</p>" +
+				"<script>if (a < b) {}</script><!-- comment --></body></html>",
+			"Title\n\nfirst paragraph\nnext  line\n\nsecond <p> あ\n",
+		},
+		{
+			"<p>list:</p><ul><li>one</li><li>two<ol><li>a</li><li>b</li></ol></li></ul><p>end</p>",
+			"list:\n\n- one\n- two\n  1. a\n  2. b\n\nend\n",
+		},
+		{
+			`<p>see <a href="https://example.com/a">this</a> and <a href='https://example.com/b'>that</a>, ` +
+				`<a href="https://example.com/a">this again</a>, <a href="https://example.com/c">https://example.com/c</a> ` +
+				`and <a href="#top">top</a>.</p>`,
+			"see this[1] and that[2], this again[1], https://example.com/c and top.\n\n[1] https://example.com/a\n[2] https://example.com/b\n",
+		},
+		{
+			"<blockquote><p>quoted</p><p>twice</p></blockquote><pre>  keep\n    spaces</pre>",
+			"> quoted\n\n> twice\n\n  keep\n    spaces\n",
+		},
+		{
+			"<table><tr><th>a</th><th>b</th></tr><tr><td>1</td><td>2</td></tr></table><img src=x alt=\"pic\"> 1 < 2",
+			"a\tb\n1\t2\n\npic 1 < 2\n",
+		},
+	}
+	for _, c := range cases {
+		if got := htmlToText(c.html); got != c.text {
+			t.Errorf("%q:\n got %q\nwant %q", c.html, got, c.text)
+		}
+	}
+}
@@ -0,0 +1,794 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/mail"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+// imapConn is a connection to an IMAP server with a box selected.
+//
+// It takes the place of imapclient.Client, which fetches BODY[] (setting \Seen),
+// knows neither UIDs nor SORT, and hides its connection from deadlines.
+// The methods named after imapclient behave the same,
+// so that imapclient.DecodeMailMessage and EncodeMailMessage still apply to the messages.
+type imapConn struct {
+	conn    net.Conn
+	r       *bufio.Reader
+	w       *bufio.Writer
+	timeout time.Duration // of each command, 0 for unlimited
+
+	tagNum int
+	caps   map[string]bool
+	broken error // set when the state of the connection is unknown
+}
+
+// imapString is an argument sent as a quoted string or a literal, as opposed to an atom.
+type imapString string
+
+// imapList is an argument sent as a parenthesized list, such as a group of search keys.
+type imapList []interface{}
+
+// imapFetched is a message in FETCH responses.
+type imapFetched struct {
+	Seq   uint32
+	UID   uint32
+	Flags []string
+	Size  int
+	Data  []byte // BODY[] or BODY[HEADER]
+}
+
+// imapResponse is an untagged or a tagged response.
+// Fields are atoms and strings (string), literals ([]byte), NIL (nil) and lists ([]interface{}).
+// Status responses (OK, NO, BAD, BYE and PREAUTH) keep the rest of the line in text instead of fields.
+type imapResponse struct {
+	tag    string
+	status string
+	text   string
+	fields []interface{}
+}
+
+// dialIMAP connects to addr over TLS and reads the greeting, in dial at the longest.
+// Each command later fails with a timeoutError after command.
+func dialIMAP(ctx context.Context, addr string, dial, command time.Duration) (*imapConn, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	d := &net.Dialer{Timeout: dial}
+	raw, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	conn := tls.Client(raw, &tls.Config{ServerName: host})
+	c := newIMAPConn(conn, command)
+	if dial > 0 {
+		conn.SetDeadline(time.Now().Add(dial))
+	}
+	if err := conn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err := c.readGreeting(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+
+	return c, nil
+}
+
+func newIMAPConn(conn net.Conn, timeout time.Duration) *imapConn {
+	return &imapConn{
+		conn:    conn,
+		r:       bufio.NewReader(conn),
+		w:       bufio.NewWriter(conn),
+		timeout: timeout,
+	}
+}
+
+func (c *imapConn) readGreeting() error {
+	resp, err := c.readResponse()
+	if err != nil {
+		return err
+	}
+	if resp.tag != "*" || (resp.status != "OK" && resp.status != "PREAUTH") {
+		return fmt.Errorf("unexpected greeting: %v %v", resp.status, resp.text)
+	}
+	return nil
+}
+
+// Login logs in with LOGIN.
+func (c *imapConn) Login(user, pass string) error {
+	_, err := c.execute("LOGIN", imapString(user), imapString(pass))
+	return err
+}
+
+// Authenticate logs in with AUTHENTICATE and an initial response, such as "XOAUTH2 base64".
+func (c *imapConn) Authenticate(s string) error {
+	_, err := c.execute("AUTHENTICATE", s)
+	return err
+}
+
+func (c *imapConn) Select(box string) error {
+	_, err := c.execute("SELECT", imapString(encodeMailboxName(box)))
+	return err
+}
+
+func (c *imapConn) Create(box string) error {
+	_, err := c.execute("CREATE", imapString(encodeMailboxName(box)))
+	return err
+}
+
+func (c *imapConn) Delete(box string) error {
+	_, err := c.execute("DELETE", imapString(encodeMailboxName(box)))
+	return err
+}
+
+// Logout logs out and closes the connection, ignoring errors.
+func (c *imapConn) Logout() {
+	if c.broken == nil {
+		c.execute("LOGOUT")
+	}
+	c.conn.Close()
+}
+
+// has reports whether the server advertises the capability, such as "SORT".
+func (c *imapConn) has(capability string) bool {
+	if c.caps == nil {
+		c.caps = make(map[string]bool)
+		resps, err := c.execute("CAPABILITY")
+		if err != nil {
+			logDebug("capability", "err", err)
+		}
+		for _, resp := range resps {
+			if len(resp.fields) == 0 || !strings.EqualFold(atomOf(resp.fields[0]), "CAPABILITY") {
+				continue
+			}
+			for _, f := range resp.fields[1:] {
+				c.caps[strings.ToUpper(atomOf(f))] = true
+			}
+		}
+	}
+	return c.caps[strings.ToUpper(capability)]
+}
+
+// Search returns sequence numbers of messages matching criteria followed by keys as strings.
+// criteria is sent as it is, so it can be a sequence set or search keys without arguments.
+func (c *imapConn) Search(criteria string, keys ...string) ([]uint32, error) {
+	args := []interface{}{criteria}
+	for _, k := range keys {
+		args = append(args, imapString(k))
+	}
+	return c.search(false, args)
+}
+
+// UIDSearch is Search returning UIDs.
+func (c *imapConn) UIDSearch(criteria string, keys ...string) ([]uint32, error) {
+	args := []interface{}{criteria}
+	for _, k := range keys {
+		args = append(args, imapString(k))
+	}
+	return c.search(true, args)
+}
+
+// search sends SEARCH (or UID SEARCH) with args of atoms and imapStrings.
+func (c *imapConn) search(uid bool, args []interface{}) ([]uint32, error) {
+	cmd := []interface{}{"SEARCH"}
+	if uid {
+		cmd = []interface{}{"UID", "SEARCH"}
+	}
+	if !asciiArgs(args) {
+		cmd = append(cmd, "CHARSET", "UTF-8")
+	}
+
+	resps, err := c.execute(append(cmd, args...)...)
+	if err != nil {
+		return nil, err
+	}
+	return numbersOf(resps, "SEARCH"), nil
+}
+
+// Sort returns sequence numbers of messages matching args, ordered by keys like "REVERSE DATE".
+// The server must have the SORT capability.
+func (c *imapConn) Sort(keys string, args []interface{}) ([]uint32, error) {
+	cmd := []interface{}{"SORT", "(" + keys + ")", "UTF-8"}
+	if len(args) == 0 {
+		args = []interface{}{"ALL"}
+	}
+
+	resps, err := c.execute(append(cmd, args...)...)
+	if err != nil {
+		return nil, err
+	}
+	return numbersOf(resps, "SORT"), nil
+}
+
+// Fetch returns messages in seqset by their sequence numbers, only headers if header is true.
+// Unlike imapclient, it does not set \Seen.
+func (c *imapConn) Fetch(seqset string, header ...bool) (map[uint32]*mail.Message, error) {
+	ff, err := c.fetch(false, seqset, header...)
+	if err != nil {
+		return nil, err
+	}
+	return mailMessagesOf(ff, func(f imapFetched) uint32 { return f.Seq })
+}
+
+// UIDFetch is Fetch by UIDs, keyed by UIDs.
+func (c *imapConn) UIDFetch(uidset string, header ...bool) (map[uint32]*mail.Message, error) {
+	ff, err := c.fetch(true, uidset, header...)
+	if err != nil {
+		return nil, err
+	}
+	return mailMessagesOf(ff, func(f imapFetched) uint32 { return f.UID })
+}
+
+// fetch returns messages with their UIDs and flags.
+func (c *imapConn) fetch(uid bool, set string, header ...bool) ([]imapFetched, error) {
+	section := "BODY.PEEK[]"
+	if len(header) > 0 && header[0] {
+		section = "BODY.PEEK[HEADER]"
+	}
+	ff, err := c.fetchItems(uid, set, "UID FLAGS "+section)
+	if err != nil {
+		return nil, err
+	}
+
+	// drop unsolicited FETCH responses (e.g. flags changed by another client)
+	var fetched []imapFetched
+	for _, f := range ff {
+		if f.Data != nil {
+			fetched = append(fetched, f)
+		}
+	}
+	return fetched, nil
+}
+
+// fetchItems sends FETCH (or UID FETCH) of items, such as "UID FLAGS RFC822.SIZE BODY.PEEK[HEADER]".
+func (c *imapConn) fetchItems(uid bool, set, items string) ([]imapFetched, error) {
+	cmd := []interface{}{"FETCH", set, "(" + items + ")"}
+	if uid {
+		cmd = append([]interface{}{"UID"}, cmd...)
+	}
+
+	resps, err := c.execute(cmd...)
+	if err != nil {
+		return nil, err
+	}
+
+	var fetched []imapFetched
+	for _, resp := range resps {
+		if len(resp.fields) != 3 || !strings.EqualFold(atomOf(resp.fields[1]), "FETCH") {
+			continue
+		}
+		seq, err := strconv.ParseUint(atomOf(resp.fields[0]), 10, 32)
+		if err != nil {
+			continue
+		}
+		list, _ := resp.fields[2].([]interface{})
+
+		f := imapFetched{Seq: uint32(seq)}
+		for i := 0; i+1 < len(list); i += 2 {
+			key := strings.ToUpper(atomOf(list[i]))
+			switch {
+			case key == "UID":
+				n, _ := strconv.ParseUint(atomOf(list[i+1]), 10, 32)
+				f.UID = uint32(n)
+			case key == "RFC822.SIZE":
+				f.Size, _ = strconv.Atoi(atomOf(list[i+1]))
+			case key == "FLAGS":
+				flags, _ := list[i+1].([]interface{})
+				f.Flags = []string{}
+				for _, flag := range flags {
+					f.Flags = append(f.Flags, atomOf(flag))
+				}
+			case strings.HasPrefix(key, "BODY["):
+				f.Data = bytesOf(list[i+1])
+				if f.Data == nil {
+					f.Data = []byte{}
+				}
+			}
+		}
+		fetched = append(fetched, f)
+	}
+	return fetched, nil
+}
+
+func (c *imapConn) Store(seqset, item string, flags []string) error {
+	_, err := c.execute("STORE", seqset, item, "("+strings.Join(flags, " ")+")")
+	return err
+}
+
+func (c *imapConn) Expunge() error {
+	_, err := c.execute("EXPUNGE")
+	return err
+}
+
+// Append appends msg to box with flags. The headers must have been encoded (see imapclient.EncodeMailMessage).
+func (c *imapConn) Append(box string, flags []string, msg mail.Message) error {
+	data, err := formatMailMessage(msg)
+	if err != nil {
+		return err
+	}
+
+	args := []interface{}{"APPEND", imapString(encodeMailboxName(box))}
+	if len(flags) > 0 {
+		args = append(args, "("+strings.Join(flags, " ")+")")
+	}
+	_, err = c.execute(append(args, data)...)
+	return err
+}
+
+// execute sends a command and returns the untagged responses to it.
+//
+// args are atoms (string), strings (imapString), literals ([]byte) and lists of them (imapList).
+// A NO or BAD response is an error leaving the connection usable;
+// any other error, including a timeout, breaks the connection.
+func (c *imapConn) execute(args ...interface{}) ([]*imapResponse, error) {
+	name := fmt.Sprint(args[0])
+	if c.broken != nil {
+		return nil, fmt.Errorf("%v: connection closed after an error (%v)", name, c.broken)
+	}
+
+	if c.timeout > 0 {
+		c.conn.SetDeadline(time.Now().Add(c.timeout))
+		defer c.conn.SetDeadline(time.Time{})
+	}
+
+	c.tagNum++
+	tag := "p" + strconv.Itoa(c.tagNum)
+
+	resps, status, err := c.send(tag, args)
+	if err != nil {
+		if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+			logWarn("timeout", "name", name, "after", c.timeout)
+			err = &timeoutError{name: name, d: c.timeout}
+		} else {
+			err = fmt.Errorf("%v: %v", name, err)
+		}
+		c.broken = err
+		c.conn.Close()
+		return nil, err
+	}
+	if status.status != "OK" {
+		return resps, fmt.Errorf("%v: %v %v", name, status.status, status.text)
+	}
+	return resps, nil
+}
+
+// send writes a command and reads responses until the tagged one.
+func (c *imapConn) send(tag string, args []interface{}) ([]*imapResponse, *imapResponse, error) {
+	var resps []*imapResponse
+
+	// waitContinuation reads responses until "+", or returns the tagged response rejecting the command
+	waitContinuation := func() (*imapResponse, error) {
+		for {
+			resp, err := c.readResponse()
+			if err != nil {
+				return nil, err
+			}
+			switch resp.tag {
+			case "+":
+				return nil, nil
+			case tag:
+				return resp, nil
+			}
+			resps = append(resps, resp)
+		}
+	}
+
+	// writeArgs writes args separated by spaces, or returns the tagged response rejecting a literal
+	var writeArgs func(args []interface{}) (*imapResponse, error)
+	writeArgs = func(args []interface{}) (*imapResponse, error) {
+		for i, arg := range args {
+			if i > 0 {
+				c.w.WriteByte(' ')
+			}
+
+			var literal []byte
+			switch a := arg.(type) {
+			case imapString:
+				if s := string(a); isQuotable(s) {
+					c.w.WriteString(quoteIMAP(s))
+				} else {
+					literal = []byte(s)
+				}
+			case []byte:
+				literal = a
+			case imapList:
+				c.w.WriteByte('(')
+				if rejected, err := writeArgs(a); rejected != nil || err != nil {
+					return rejected, err
+				}
+				c.w.WriteByte(')')
+			default:
+				c.w.WriteString(fmt.Sprint(a))
+			}
+			if literal == nil {
+				continue
+			}
+
+			fmt.Fprintf(c.w, "{%d}\r\n", len(literal))
+			if err := c.w.Flush(); err != nil {
+				return nil, err
+			}
+			rejected, err := waitContinuation()
+			if rejected != nil || err != nil {
+				return rejected, err
+			}
+			c.w.Write(literal)
+		}
+		return nil, nil
+	}
+
+	c.w.WriteString(tag + " ")
+	rejected, err := writeArgs(args)
+	if err != nil {
+		return nil, nil, err
+	}
+	if rejected != nil {
+		return resps, rejected, nil
+	}
+	c.w.WriteString("\r\n")
+	if err := c.w.Flush(); err != nil {
+		return nil, nil, err
+	}
+
+	for {
+		resp, err := c.readResponse()
+		if err != nil {
+			return nil, nil, err
+		}
+		switch resp.tag {
+		case tag:
+			return resps, resp, nil
+		case "+":
+			// a challenge after a failed AUTHENTICATE; cancel it to get the tagged NO
+			c.w.WriteString("\r\n")
+			if err := c.w.Flush(); err != nil {
+				return nil, nil, err
+			}
+		default:
+			if resp.status == "BYE" {
+				logDebug("imap", "bye", resp.text)
+			}
+			resps = append(resps, resp)
+		}
+	}
+}
+
+// readResponse reads a response, including the literals in it.
+func (c *imapConn) readResponse() (*imapResponse, error) {
+	p := &imapParser{r: c.r}
+	if err := p.nextLine(); err != nil {
+		return nil, err
+	}
+
+	resp := &imapResponse{}
+	resp.tag = p.word()
+	if resp.tag == "+" {
+		resp.text = p.rest()
+		return resp, nil
+	}
+
+	if resp.tag != "*" {
+		resp.status = strings.ToUpper(p.word())
+		resp.text = p.rest()
+		return resp, nil
+	}
+
+	// untagged status, or data
+	mark := p.pos
+	switch w := strings.ToUpper(p.word()); w {
+	case "OK", "NO", "BAD", "BYE", "PREAUTH":
+		resp.status = w
+		resp.text = p.rest()
+		return resp, nil
+	}
+	p.pos = mark
+
+	for {
+		v, ok, err := p.value()
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			break
+		}
+		resp.fields = append(resp.fields, v)
+	}
+	return resp, nil
+}
+
+// imapParser reads values of a response line by line, reading literals between lines.
+type imapParser struct {
+	r    *bufio.Reader
+	line string
+	pos  int
+}
+
+func (p *imapParser) nextLine() error {
+	line, err := p.r.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	p.line = strings.TrimRight(line, "\r\n")
+	p.pos = 0
+	return nil
+}
+
+func (p *imapParser) skipSpaces() {
+	for p.pos < len(p.line) && p.line[p.pos] == ' ' {
+		p.pos++
+	}
+}
+
+// word returns the text up to the next space.
+func (p *imapParser) word() string {
+	p.skipSpaces()
+	start := p.pos
+	for p.pos < len(p.line) && p.line[p.pos] != ' ' {
+		p.pos++
+	}
+	return p.line[start:p.pos]
+}
+
+// rest returns the rest of the line.
+func (p *imapParser) rest() string {
+	p.skipSpaces()
+	s := p.line[p.pos:]
+	p.pos = len(p.line)
+	return s
+}
+
+// value returns the next value, or ok=false at the end of the response or of a list.
+func (p *imapParser) value() (v interface{}, ok bool, err error) {
+	p.skipSpaces()
+	if p.pos >= len(p.line) {
+		return nil, false, nil
+	}
+
+	switch p.line[p.pos] {
+	case ')':
+		return nil, false, nil
+
+	case '(':
+		p.pos++
+		list := []interface{}{}
+		for {
+			v, ok, err := p.value()
+			if err != nil {
+				return nil, false, err
+			}
+			if !ok {
+				break
+			}
+			list = append(list, v)
+		}
+		if p.pos >= len(p.line) || p.line[p.pos] != ')' {
+			return nil, false, fmt.Errorf("unclosed list in response: %q", p.line)
+		}
+		p.pos++
+		return list, true, nil
+
+	case '"':
+		var b strings.Builder
+		for p.pos++; p.pos < len(p.line); p.pos++ {
+			switch ch := p.line[p.pos]; ch {
+			case '\\':
+				p.pos++
+				if p.pos < len(p.line) {
+					b.WriteByte(p.line[p.pos])
+				}
+			case '"':
+				p.pos++
+				return b.String(), true, nil
+			default:
+				b.WriteByte(ch)
+			}
+		}
+		return nil, false, fmt.Errorf("unclosed string in response: %q", p.line)
+
+	case '{':
+		end := strings.IndexByte(p.line[p.pos:], '}')
+		if end < 0 || p.pos+end != len(p.line)-1 {
+			return nil, false, fmt.Errorf("broken literal in response: %q", p.line)
+		}
+		n, err := strconv.Atoi(strings.TrimSuffix(p.line[p.pos+1:p.pos+end], "+"))
+		if err != nil {
+			return nil, false, fmt.Errorf("broken literal in response: %q", p.line)
+		}
+		data := make([]byte, n)
+		if _, err := io.ReadFull(p.r, data); err != nil {
+			return nil, false, err
+		}
+		if err := p.nextLine(); err != nil {
+			return nil, false, err
+		}
+		return data, true, nil
+	}
+
+	// an atom, which may have [...] with spaces and parentheses like BODY[HEADER.FIELDS (SUBJECT)]
+	start := p.pos
+	depth := 0
+loop:
+	for ; p.pos < len(p.line); p.pos++ {
+		switch p.line[p.pos] {
+		case '[':
+			depth++
+		case ']':
+			depth--
+		case ' ', '(', ')':
+			if depth <= 0 {
+				break loop
+			}
+		}
+	}
+	atom := p.line[start:p.pos]
+	if strings.EqualFold(atom, "NIL") {
+		return nil, true, nil
+	}
+	return atom, true, nil
+}
+
+func atomOf(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	}
+	return ""
+}
+
+func bytesOf(v interface{}) []byte {
+	switch v := v.(type) {
+	case string:
+		return []byte(v)
+	case []byte:
+		return v
+	}
+	return nil
+}
+
+// numbersOf collects numbers of untagged responses of name, such as "* SEARCH 2 3 5".
+func numbersOf(resps []*imapResponse, name string) []uint32 {
+	nums := []uint32{}
+	for _, resp := range resps {
+		if len(resp.fields) == 0 || !strings.EqualFold(atomOf(resp.fields[0]), name) {
+			continue
+		}
+		for _, f := range resp.fields[1:] {
+			if n, err := strconv.ParseUint(atomOf(f), 10, 32); err == nil {
+				nums = append(nums, uint32(n))
+			}
+		}
+	}
+	return nums
+}
+
+func mailMessagesOf(ff []imapFetched, key func(imapFetched) uint32) (map[uint32]*mail.Message, error) {
+	mm := make(map[uint32]*mail.Message, len(ff))
+	for _, f := range ff {
+		m, err := mail.ReadMessage(bytes.NewReader(f.Data))
+		if err != nil {
+			return nil, fmt.Errorf("broken message #%d: %v", f.Seq, err)
+		}
+		mm[key(f)] = m
+	}
+	return mm, nil
+}
+
+// formatMailMessage returns msg as a message for APPEND, in CRLF.
+func formatMailMessage(msg mail.Message) ([]byte, error) {
+	var buff bytes.Buffer
+
+	keys := make([]string, 0, len(msg.Header))
+	for k := range msg.Header {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		for _, v := range msg.Header[k] {
+			buff.WriteString(k + ": " + v + "\n")
+		}
+	}
+	buff.WriteString("\n")
+
+	if msg.Body != nil {
+		body, err := ioutil.ReadAll(msg.Body)
+		if err != nil {
+			return nil, err
+		}
+		buff.Write(body)
+	}
+
+	data := bytes.Replace(buff.Bytes(), []byte("\r\n"), []byte("\n"), -1)
+	return bytes.Replace(data, []byte("\n"), []byte("\r\n"), -1), nil
+}
+
+// isQuotable reports whether s can be sent as a quoted string (7-bit, no CR or LF).
+func isQuotable(s string) bool {
+	if len(s) > 1000 {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if b := s[i]; b == 0 || b == '\r' || b == '\n' || b >= 0x80 {
+			return false
+		}
+	}
+	return true
+}
+
+func quoteIMAP(s string) string {
+	s = strings.Replace(s, `\`, `\\`, -1)
+	return `"` + strings.Replace(s, `"`, `\"`, -1) + `"`
+}
+
+func asciiArgs(args []interface{}) bool {
+	for _, a := range args {
+		switch a := a.(type) {
+		case imapString:
+			for i := 0; i < len(a); i++ {
+				if a[i] >= 0x80 {
+					return false
+				}
+			}
+		case imapList:
+			if !asciiArgs(a) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// encodeMailboxName encodes name in modified UTF-7 of RFC 3501.
+func encodeMailboxName(name string) string {
+	var b strings.Builder
+	var pending []rune
+
+	flush := func() {
+		if len(pending) == 0 {
+			return
+		}
+		var raw []byte
+		for _, u := range utf16.Encode(pending) {
+			raw = append(raw, byte(u>>8), byte(u))
+		}
+		s := base64.StdEncoding.EncodeToString(raw)
+		s = strings.TrimRight(s, "=")
+		b.WriteString("&" + strings.Replace(s, "/", ",", -1) + "-")
+		pending = pending[:0]
+	}
+
+	for _, r := range name {
+		if r >= 0x20 && r <= 0x7e {
+			flush()
+			if r == '&' {
+				b.WriteString("&-")
+			} else {
+				b.WriteRune(r)
+			}
+			continue
+		}
+		pending = append(pending, r)
+	}
+	flush()
+
+	return b.String()
+}
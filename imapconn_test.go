@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/mail"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeIMAPStep is a command the fake server expects (without the tag, literals inlined),
+// and its reply lines where TAG is replaced by the tag. No reply lines means no response at all.
+type fakeIMAPStep struct {
+	Command string
+	Reply   []string
+}
+
+var literalSpecRe = regexp.MustCompile(`\{(\d+)\}$`)
+
+// startFakeIMAP serves steps on one end of a pipe and returns the client connected to the other end.
+func startFakeIMAP(t *testing.T, timeout time.Duration, steps []fakeIMAPStep) *imapConn {
+	client, server := net.Pipe()
+
+	go func() {
+		defer server.Close()
+		r := bufio.NewReader(server)
+		for _, step := range steps {
+			var cmd string
+			for {
+				line, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				line = strings.TrimRight(line, "\r\n")
+				m := literalSpecRe.FindStringSubmatch(line)
+				if m == nil {
+					cmd += line
+					break
+				}
+				n, _ := strconv.Atoi(m[1])
+				io.WriteString(server, "+ go ahead\r\n")
+				data := make([]byte, n)
+				if _, err := io.ReadFull(r, data); err != nil {
+					return
+				}
+				cmd += line + string(data)
+			}
+
+			tag := cmd[:strings.IndexByte(cmd, ' ')]
+			if got := cmd[len(tag)+1:]; got != step.Command {
+				t.Errorf("got command %q, want %q", got, step.Command)
+			}
+			if len(step.Reply) == 0 {
+				io.Copy(ioutil.Discard, r)
+				return
+			}
+			for _, line := range step.Reply {
+				io.WriteString(server, strings.Replace(line, "TAG", tag, -1)+"\r\n")
+			}
+		}
+	}()
+
+	return newIMAPConn(client, timeout)
+}
+
+func TestIMAPConnFetch(t *testing.T) {
+	msg := "Subject: memo\r\n\r\nbody (with parens)\r\n"
+	c := startFakeIMAP(t, time.Second, []fakeIMAPStep{
+		{
+			Command: "FETCH 1:2 (UID FLAGS BODY.PEEK[])",
+			Reply: []string{
+				"* 1 FETCH (UID 10 BODY[] {" + strconv.Itoa(len(msg)) + "}\r\n" + msg + ")",
+				"* 2 FETCH (FLAGS (\\Seen))",
+				"* 2 FETCH (BODY[] {21}\r\nSubject: \"quoted\"\r\n\r\n UID 11 FLAGS (\\Seen \"x\"))",
+				"TAG OK FETCH completed",
+			},
+		},
+		{
+			Command: "UID FETCH 10 (UID FLAGS BODY.PEEK[HEADER])",
+			Reply: []string{
+				"* 1 FETCH (UID 10 BODY[HEADER] {17}\r\nSubject: memo\r\n\r\n)",
+				"TAG OK done",
+			},
+		},
+	})
+
+	mm, err := c.Fetch("1:2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mm) != 2 || mm[1].Header.Get("Subject") != "memo" || mm[2].Header.Get("Subject") != `"quoted"` {
+		t.Fatalf("fetched %v", mm)
+	}
+	if body, _ := ioutil.ReadAll(mm[1].Body); string(body) != "body (with parens)\r\n" {
+		t.Errorf("body = %q", body)
+	}
+
+	mm, err = c.UIDFetch("10", true)
+	if err != nil || len(mm) != 1 || mm[10] == nil || mm[10].Header.Get("Subject") != "memo" {
+		t.Errorf("fetched by UID %v, %v", mm, err)
+	}
+}
+
+func TestIMAPConnCommands(t *testing.T) {
+	c := startFakeIMAP(t, time.Second, []fakeIMAPStep{
+		{
+			Command: "SEARCH CHARSET UTF-8 SUBJECT {6}会議",
+			Reply:   []string{"* SEARCH 2 5", "TAG OK SEARCH completed"},
+		},
+		{
+			Command: `SEARCH NOT SEEN SUBJECT "a \"b\""`,
+			Reply:   []string{"* 3 EXISTS", "* SEARCH", "TAG OK SEARCH completed"},
+		},
+		{
+			Command: "CAPABILITY",
+			Reply:   []string{"* CAPABILITY IMAP4rev1 SORT UIDPLUS", "TAG OK done"},
+		},
+		{
+			Command: "SORT (REVERSE DATE) UTF-8 ALL",
+			Reply:   []string{"* SORT 3 1 2", "TAG OK done"},
+		},
+		{
+			Command: "SELECT \"&ZeVnLIqe-/a&-b\"",
+			Reply:   []string{"TAG NO [NONEXISTENT] Unknown Mailbox"},
+		},
+		{
+			Command: "APPEND \"Notes\" (\\Seen) {26}Subject: s\r\n\r\nline1\r\nline2",
+			Reply:   []string{"TAG OK [APPENDUID 1 3] done"},
+		},
+	})
+
+	if seqs, err := c.Search("SUBJECT", "会議"); err != nil || joinUint32(seqs, ",") != "2,5" {
+		t.Errorf("search = %v, %v", seqs, err)
+	}
+	if seqs, err := c.Search("NOT SEEN SUBJECT", `a "b"`); err != nil || len(seqs) != 0 {
+		t.Errorf("search = %v, %v", seqs, err)
+	}
+
+	if !c.has("sort") || c.has("ESORT") {
+		t.Errorf("capabilities = %v", c.caps)
+	}
+	if seqs, err := c.Sort("REVERSE DATE", nil); err != nil || joinUint32(seqs, ",") != "3,1,2" {
+		t.Errorf("sort = %v, %v", seqs, err)
+	}
+
+	if err := c.Select("日本語/a&b"); err == nil || !strings.Contains(err.Error(), "Unknown Mailbox") {
+		t.Errorf("select = %v", err)
+	}
+
+	// still usable after NO
+	msg := mail.Message{Header: mail.Header{"Subject": []string{"s"}}, Body: strings.NewReader("line1\nline2")}
+	if err := c.Append("Notes", []string{flagSeen}, msg); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+// imapPool keeps up to size idle, logged-in connections to be shared by workers.
+type imapPool struct {
+	config *config
+	conns  chan *imapConn
+}
+
+func newIMAPPool(config *config, size int) *imapPool {
+	return &imapPool{
+		config: config,
+		conns:  make(chan *imapConn, size),
+	}
+}
+
+// get returns an idle connection or a new one.
+// A failure of a new connection is not retried here; callers retry the whole work.
+func (p *imapPool) get() (*imapConn, error) {
+	select {
+	case c := <-p.conns:
+		return c, nil
+	default:
+		return openIMAP(rootCtx, p.config)
+	}
+}
+
+// release returns c to the pool.
+// A broken connection (after an error, its state is unknown) is closed instead.
+func (p *imapPool) release(c *imapConn, broken bool) {
+	if broken {
+		c.Logout()
+		return
+	}
+
+	select {
+	case p.conns <- c:
+	default:
+		c.Logout()
+	}
+}
+
+// close logs out all idle connections.
+func (p *imapPool) close() {
+	for {
+		select {
+		case c := <-p.conns:
+			c.Logout()
+		default:
+			return
+		}
+	}
+}
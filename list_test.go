@@ -1,6 +1,8 @@
 package main
 
 import (
+	"reflect"
+	"strconv"
 	"testing"
 	"time"
 )
@@ -53,3 +55,92 @@ func TestList(t *testing.T) {
 	teardownTestBox(t, config, ic)
 	ic.Logout()
 }
+
+func TestSortList(t *testing.T) {
+	list := []listElement{
+		{Seq: 1, Subject: "b", Date: "Tue, 04 Jun 2024 10:00:00 +0900", Size: 30},
+		{Seq: 2, Subject: "c", Date: "Mon, 03 Jun 2024 10:00:00 +0900", Size: 10},
+		{Seq: 3, Subject: "a", Date: "Wed, 05 Jun 2024 09:00:00 +0000", Size: 20},
+	}
+
+	testdata := []struct {
+		Key     string
+		Reverse bool
+		Want    []uint32
+	}{
+		{Key: "seq", Want: []uint32{1, 2, 3}},
+		{Key: "date", Want: []uint32{2, 1, 3}},
+		{Key: "date", Reverse: true, Want: []uint32{3, 1, 2}},
+		{Key: "subject", Want: []uint32{3, 1, 2}},
+		{Key: "size", Reverse: true, Want: []uint32{1, 3, 2}},
+	}
+
+	for _, d := range testdata {
+		l := append([]listElement{}, list...)
+		if err := sortList(l, d.Key, d.Reverse); err != nil {
+			t.Errorf("sortList(%q): %v", d.Key, err)
+			continue
+		}
+		got := make([]uint32, len(l))
+		for i, e := range l {
+			got[i] = e.Seq
+		}
+		if !reflect.DeepEqual(got, d.Want) {
+			t.Errorf("sortList(%q, %v) = %v, want %v", d.Key, d.Reverse, got, d.Want)
+		}
+	}
+}
+
+func TestListMessagesSorted(t *testing.T) {
+	fetched := func(seq, uid int, subject string) string {
+		header := "Subject: " + subject + "\r\nDate: Mon, 03 Jun 2024 10:00:00 +0900\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n"
+		return "* " + strconv.Itoa(seq) + " FETCH (UID " + strconv.Itoa(uid) + " FLAGS () BODY[HEADER] {" + strconv.Itoa(len(header)) + "}\r\n" + header + ")"
+	}
+
+	// by the server, fetching only the page
+	c := startFakeIMAP(t, time.Second, []fakeIMAPStep{
+		{Command: "CAPABILITY", Reply: []string{"* CAPABILITY IMAP4rev1 SORT", "TAG OK done"}},
+		{Command: `SORT (REVERSE DATE) UTF-8 SUBJECT "memo"`, Reply: []string{"* SORT 3 1 2", "TAG OK done"}},
+		{
+			Command: "FETCH 3,1 (UID FLAGS BODY.PEEK[HEADER])",
+			Reply:   []string{fetched(1, 11, "memo a"), fetched(3, 13, "memo c"), "TAG OK done"},
+		},
+	})
+	list, err := listMessagesWithOptions(c, "SUBJECT", "memo", listOptions{Sort: "date", Reverse: true, Limit: 2})
+	if err != nil || len(list) != 2 || list[0].UID != 13 || list[1].Subject != "memo a" {
+		t.Errorf("sorted by the server: %v, %v", list, err)
+	}
+
+	// without SORT
+	c = startFakeIMAP(t, time.Second, []fakeIMAPStep{
+		{Command: "CAPABILITY", Reply: []string{"* CAPABILITY IMAP4rev1", "TAG OK done"}},
+		{Command: `SEARCH SUBJECT "memo"`, Reply: []string{"* SEARCH 2 1", "TAG OK done"}},
+		{
+			Command: "FETCH 1,2 (UID FLAGS BODY.PEEK[HEADER])",
+			Reply:   []string{fetched(1, 11, "memo b"), fetched(2, 12, "memo a"), "TAG OK done"},
+		},
+	})
+	list, err = listMessagesWithOptions(c, "SUBJECT", "memo", listOptions{Sort: "subject", Limit: 1})
+	if err != nil || len(list) != 1 || list[0].Seq != 2 {
+		t.Errorf("sorted locally: %v, %v", list, err)
+	}
+}
+
+func TestPageRange(t *testing.T) {
+	testdata := []struct {
+		N, Offset, Limit int
+		Start, End       int
+	}{
+		{10, 0, 0, 0, 10},
+		{10, 2, 3, 2, 5},
+		{10, 8, 5, 8, 10},
+		{10, 20, 5, 10, 10},
+		{10, -1, 5, 0, 5},
+	}
+
+	for _, d := range testdata {
+		if start, end := pageRange(d.N, d.Offset, d.Limit); start != d.Start || end != d.End {
+			t.Errorf("pageRange(%v, %v, %v) = %v, %v, want %v, %v", d.N, d.Offset, d.Limit, start, end, d.Start, d.End)
+		}
+	}
+}
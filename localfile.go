@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+)
+
+// localFormat is how local files differ from messages.
+//
+// Messages keep what the Pomera writes: UTF-8 with BOM.
+// With LineEnding set, local files use it and messages use CRLF,
+// so a file got and put again without changes results in the very same message.
+type localFormat struct {
+	Encoding   string // "" for UTF-8
+	LineEnding string // "" to preserve, "lf" or "crlf"
+	StripBOM   bool   // UTF-8 files without BOM
+}
+
+// localFormatOf returns the format of local files: the flags if given, otherwise [LOCAL].
+func localFormatOf(config *config, encFlag, eolFlag string) (localFormat, error) {
+	var f localFormat
+	var err error
+
+	enc := config.LOCAL.Encoding
+	if encFlag != "" {
+		enc = encFlag
+	}
+	if f.Encoding, err = normalizeEncodingName(enc); err != nil {
+		return f, err
+	}
+
+	eol := config.LOCAL.LineEnding
+	if eolFlag != "" {
+		eol = eolFlag
+	}
+	if f.LineEnding, err = normalizeLineEnding(eol); err != nil {
+		return f, err
+	}
+
+	f.StripBOM = config.LOCAL.StripBOM
+
+	return f, nil
+}
+
+func normalizeLineEnding(name string) (string, error) {
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case "", "preserve":
+		return "", nil
+	case "lf", "unix":
+		return "lf", nil
+	case "crlf", "dos", "windows":
+		return "crlf", nil
+	}
+	return "", fmt.Errorf("unsupported line ending %q (lf, crlf, preserve)", name)
+}
+
+// toRemote converts data of a local file name into the body of a message (BOM is added by putMessage).
+func (f localFormat) toRemote(name string, data []byte) ([]byte, error) {
+	converted, used, err := toUTF8(data, f.Encoding)
+	if err != nil {
+		return nil, err
+	}
+	if used != "" && used != f.Encoding {
+		logInfo("encoding detected", "file", name, "encoding", used)
+		fmt.Fprintf(os.Stderr, "%v: converted from %v\n", name, used)
+	}
+
+	if f.LineEnding != "" {
+		converted = convertLineEnding(converted, "\r\n")
+	}
+
+	return converted, nil
+}
+
+// toLocal converts the body of a message subject into the content of a local file.
+func (f localFormat) toLocal(subject string, data []byte) ([]byte, error) {
+	switch f.LineEnding {
+	case "lf":
+		data = convertLineEnding(data, "\n")
+	case "crlf":
+		data = convertLineEnding(data, "\r\n")
+	}
+
+	if f.StripBOM {
+		data = bytes.TrimPrefix(data, utf8BOM)
+	}
+
+	encoded, replaced, err := fromUTF8(data, f.Encoding)
+	if err != nil {
+		return nil, fmt.Errorf("on subject[%v]: %v", subject, err)
+	}
+	if replaced > 0 {
+		logWarn("replaced characters", "subject", subject, "encoding", f.Encoding, "count", replaced)
+		fmt.Fprintf(os.Stderr, "%v: %d character(s) not in %v are replaced\n", subject, replaced, f.Encoding)
+	}
+
+	return encoded, nil
+}
+
+// convertLineEnding replaces every CRLF, CR and LF in data with nl.
+func convertLineEnding(data []byte, nl string) []byte {
+	buff := bytes.NewBuffer(make([]byte, 0, len(data)+len(data)/32))
+	for i := 0; i < len(data); i++ {
+		switch c := data[i]; c {
+		case '\r':
+			if i+1 < len(data) && data[i+1] == '\n' {
+				i++
+			}
+			buff.WriteString(nl)
+		case '\n':
+			buff.WriteString(nl)
+		default:
+			buff.WriteByte(c)
+		}
+	}
+	return buff.Bytes()
+}
+
+// writer converts messages by toLocal before passing them to w.
+func (f localFormat) writer(w MsgWriter) MsgWriter {
+	if f == (localFormat{}) {
+		return w
+	}
+
+	return func(syncDirPath, subject, ext string, tm time.Time, r io.Reader) error {
+		data, err := ioutil.ReadAll(r)
+		if err != nil {
+			return fmt.Errorf("on subject[%v]: body reading error: %v", subject, err)
+		}
+
+		data, err = f.toLocal(subject, data)
+		if err != nil {
+			return err
+		}
+
+		return w(syncDirPath, subject, ext, tm, bytes.NewReader(data))
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestConvertLineEnding(t *testing.T) {
+	src := []byte("a\r\nb\nc\rd\r\n\r\n")
+	if got := string(convertLineEnding(src, "\n")); got != "a\nb\nc\nd\n\n" {
+		t.Errorf("lf: %q", got)
+	}
+	if got := string(convertLineEnding(src, "\r\n")); got != "a\r\nb\r\nc\r\nd\r\n\r\n" {
+		t.Errorf("crlf: %q", got)
+	}
+}
+
+func TestLocalFormatRoundTrip(t *testing.T) {
+	remote := append(append([]byte(nil), utf8BOM...), "line1\r\nline2\r\n"...)
+
+	cases := []struct {
+		format localFormat
+		local  string
+	}{
+		{localFormat{}, string(remote)},
+		{localFormat{LineEnding: "lf", StripBOM: true}, "line1\nline2\n"},
+		{localFormat{LineEnding: "crlf", StripBOM: true}, "line1\r\nline2\r\n"},
+		{localFormat{LineEnding: "lf"}, "\ufeffline1\nline2\n"},
+	}
+	for _, c := range cases {
+		local, err := c.format.toLocal("test", remote)
+		if err != nil || string(local) != c.local {
+			t.Errorf("%+v: toLocal = %q, %v", c.format, local, err)
+			continue
+		}
+
+		back, err := c.format.toRemote("test", local)
+		if err != nil {
+			t.Errorf("%+v: toRemote: %v", c.format, err)
+			continue
+		}
+		if !bytes.HasPrefix(back, utf8BOM) {
+			// putMessage adds it
+			back = append(append([]byte(nil), utf8BOM...), back...)
+		}
+		if !bytes.Equal(back, remote) {
+			t.Errorf("%+v: round trip = %q", c.format, back)
+		}
+	}
+}
+
+func TestSameDate(t *testing.T) {
+	if !sameDate("Mon, 02 Jan 2006 15:04:05 +0900", "Mon, 2 Jan 2006 06:04:05 +0000") {
+		t.Error("same time in different zones")
+	}
+	if sameDate("Mon, 02 Jan 2006 15:04:05 +0900", "Mon, 02 Jan 2006 15:04:06 +0900") {
+		t.Error("different times")
+	}
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+type logLevel int
+
+const (
+	levelTrace logLevel = iota
+	levelDebug
+	levelInfo
+	levelWarn
+	levelError
+	levelOff
+)
+
+var logLevelNames = []string{"TRACE", "DEBUG", "INFO", "WARN", "ERROR", "OFF"}
+
+func (l logLevel) String() string {
+	return logLevelNames[l]
+}
+
+func parseLogLevel(s string) (logLevel, error) {
+	for i, name := range logLevelNames {
+		if strings.EqualFold(s, name) {
+			return logLevel(i), nil
+		}
+	}
+	return levelOff, fmt.Errorf("unknown log level %q", s)
+}
+
+// logger writes leveled records with key-value fields, in text or JSON lines.
+// Every message and value is redacted before written.
+type logger struct {
+	mu    sync.Mutex
+	w     io.Writer
+	level logLevel
+	json  bool
+
+	now func() time.Time // for tests
+}
+
+// plog is the logger of the process. It is off until setupLogging.
+var plog = &logger{level: levelOff, now: time.Now}
+
+// setupLogging configures plog.
+//
+// Records go to logFile, POMI_LOG or stderr in this order.
+// The level is DEBUG with verbose or POMI_LOG, TRACE with trace, INFO with logFile, and OFF otherwise.
+// POMI_LOG_LEVEL overrides the level.
+// A file name prefixed with '*' is truncated instead of appended.
+func setupLogging(verbose, trace bool, logFile, format string) error {
+	level := levelOff
+	dest := logFile
+	if dest == "" {
+		dest = os.Getenv("POMI_LOG")
+		if dest != "" {
+			level = levelDebug
+		}
+	} else {
+		level = levelInfo
+	}
+	if verbose && level > levelDebug {
+		level = levelDebug
+	}
+	if trace {
+		level = levelTrace
+	}
+	if env := os.Getenv("POMI_LOG_LEVEL"); env != "" {
+		l, err := parseLogLevel(env)
+		if err != nil {
+			return err
+		}
+		level = l
+	}
+	if format == "" {
+		format = os.Getenv("POMI_LOG_FORMAT")
+	}
+
+	var w io.Writer = os.Stderr
+	if dest != "" && level != levelOff {
+		flags := os.O_CREATE | os.O_WRONLY | os.O_APPEND
+		if dest[0] == '*' {
+			flags = os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+			dest = dest[1:]
+		}
+		f, err := os.OpenFile(dest, flags, 0600)
+		if err != nil {
+			return fmt.Errorf("failed to open log file %v: %v", dest, err)
+		}
+		w = f
+	}
+
+	switch format {
+	case "", "text", "json":
+	default:
+		return fmt.Errorf("unknown log format %q", format)
+	}
+
+	plog.mu.Lock()
+	defer plog.mu.Unlock()
+
+	plog.w = w
+	plog.level = level
+	plog.json = format == "json"
+
+	return nil
+}
+
+func (l *logger) enabled(level logLevel) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.w != nil && level >= l.level && level < levelOff
+}
+
+// log writes a record of msg and fields given as key, value, key, value...
+func (l *logger) log(level logLevel, msg string, kv ...interface{}) {
+	if !l.enabled(level) {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	tm := l.now().Format("2006-01-02T15:04:05.000Z07:00")
+	msg = redact(msg)
+
+	buff := new(bytes.Buffer)
+	if l.json {
+		rec := map[string]interface{}{
+			"time":  tm,
+			"level": strings.ToLower(level.String()),
+			"msg":   msg,
+		}
+		for i := 0; i < len(kv); i += 2 {
+			rec[fmt.Sprint(kv[i])] = logValue(kv, i+1)
+		}
+		data, err := json.Marshal(rec)
+		if err != nil {
+			return
+		}
+		buff.Write(data)
+	} else {
+		fmt.Fprintf(buff, "%v %-5v %v", tm, level, msg)
+		for i := 0; i < len(kv); i += 2 {
+			fmt.Fprintf(buff, " %v=%v", kv[i], quoteLogValue(logValue(kv, i+1)))
+		}
+	}
+	buff.WriteByte('\n')
+
+	l.w.Write(buff.Bytes())
+}
+
+// logValue returns the redacted value at kv[i] in a form that encoding/json marshals as expected.
+func logValue(kv []interface{}, i int) interface{} {
+	if i >= len(kv) {
+		return "(missing)"
+	}
+
+	switch v := kv[i].(type) {
+	case nil:
+		return nil
+	case error:
+		return redact(v.Error())
+	case string:
+		return redact(v)
+	case fmt.Stringer:
+		return redact(v.String())
+	case int, int64, uint32, bool, float64:
+		return v
+	case time.Duration:
+		return v.String()
+	case time.Time:
+		return v.Format(time.RFC3339)
+	case []string:
+		ss := make([]string, len(v))
+		for i, s := range v {
+			ss[i] = redact(s)
+		}
+		return ss
+	default:
+		return redact(fmt.Sprint(v))
+	}
+}
+
+func quoteLogValue(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		if v == "" || strings.ContainsAny(v, " \t\r\n\"=") {
+			return fmt.Sprintf("%q", v)
+		}
+		return v
+	case []string:
+		return quoteLogValue(strings.Join(v, ","))
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+func logTrace(msg string, kv ...interface{}) { plog.log(levelTrace, msg, kv...) }
+func logDebug(msg string, kv ...interface{}) { plog.log(levelDebug, msg, kv...) }
+func logInfo(msg string, kv ...interface{})  { plog.log(levelInfo, msg, kv...) }
+func logWarn(msg string, kv ...interface{})  { plog.log(levelWarn, msg, kv...) }
+func logError(msg string, kv ...interface{}) { plog.log(levelError, msg, kv...) }
+
+var redactPatterns = []struct {
+	re   *regexp.Regexp
+	repl string
+}{
+	// OAuth form values and JSON fields
+	{regexp.MustCompile(`(?i)((?:client_secret|refresh_token|access_token|id_token|code|password|pass)=)[^&\s"]+`), "${1}***"},
+	{regexp.MustCompile(`(?i)("(?:client_secret|refresh_token|access_token|id_token|password)"\s*:\s*")[^"]*`), "${1}***"},
+	// IMAP AUTHENTICATE and the SASL payload
+	{regexp.MustCompile(`(?i)(XOAUTH2\s+)\S+`), "${1}***"},
+	{regexp.MustCompile(`(?i)(auth=Bearer\s+)[^\x01\s]+`), "${1}***"},
+	// IMAP LOGIN user pass
+	{regexp.MustCompile(`(?i)(\bLOGIN\s+\S+\s+)\S+`), "${1}***"},
+}
+
+var (
+	secretsMu sync.Mutex
+	secrets   []string
+)
+
+// addLogSecret makes s masked wherever it appears in logs.
+func addLogSecret(s string) {
+	if len(s) < 4 {
+		return // too short to mask without breaking everything else
+	}
+
+	secretsMu.Lock()
+	defer secretsMu.Unlock()
+
+	for _, t := range secrets {
+		if t == s {
+			return
+		}
+	}
+	secrets = append(secrets, s)
+}
+
+// redact masks credentials and tokens in s.
+func redact(s string) string {
+	secretsMu.Lock()
+	for _, t := range secrets {
+		s = strings.Replace(s, t, "***", -1)
+	}
+	secretsMu.Unlock()
+
+	for _, p := range redactPatterns {
+		s = p.re.ReplaceAllString(s, p.repl)
+	}
+	return s
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRedact(t *testing.T) {
+	addLogSecret("s3cr3t-pass")
+
+	cases := []struct {
+		src, leaked string
+	}{
+		{"client_id=x&client_secret=abc&refresh_token=1//xyz&grant_type=refresh_token", "1//xyz"},
+		{`{"access_token": "ya29.abc", "expires_in": 3599}`, "ya29.abc"},
+		{"AUTHENTICATE XOAUTH2 dXNlcj1mb29AZXhhbXBsZS5jb20B", "dXNlcj1"},
+		{"LOGIN foo@example.com hunter22", "hunter22"},
+		{"failed: s3cr3t-pass is wrong", "s3cr3t-pass"},
+	}
+	for _, c := range cases {
+		got := redact(c.src)
+		if strings.Contains(got, c.leaked) {
+			t.Errorf("redact(%q) = %q, leaking %q", c.src, got, c.leaked)
+		}
+		if !strings.Contains(got, "***") {
+			t.Errorf("redact(%q) = %q, not masked", c.src, got)
+		}
+	}
+
+	if got := redact("SEARCH SUBJECT memo"); got != "SEARCH SUBJECT memo" {
+		t.Errorf("redact changed a harmless string: %q", got)
+	}
+}
+
+func TestLogger(t *testing.T) {
+	tm := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	buff := new(bytes.Buffer)
+	l := &logger{w: buff, level: levelInfo, now: func() time.Time { return tm }}
+
+	l.log(levelDebug, "hidden")
+	l.log(levelInfo, "put", "file", "a b.txt", "size", 3)
+	l.log(levelError, "get", "err", errors.New("LOGIN me pw123"))
+
+	want := `2020-01-02T03:04:05.000Z INFO  put file="a b.txt" size=3
+2020-01-02T03:04:05.000Z ERROR get err="LOGIN me ***"
+`
+	if got := buff.String(); got != want {
+		t.Errorf("text:\n%v\nwant:\n%v", got, want)
+	}
+
+	buff.Reset()
+	l.json = true
+	l.log(levelWarn, "retry", "attempt", 2)
+
+	var rec map[string]interface{}
+	if err := json.Unmarshal(buff.Bytes(), &rec); err != nil {
+		t.Fatalf("json: %v: %s", err, buff.Bytes())
+	}
+	if rec["level"] != "warn" || rec["msg"] != "retry" || rec["attempt"] != 2.0 {
+		t.Errorf("json: %v", rec)
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"html"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var (
+	mdHeadingRe     = regexp.MustCompile(`^(#{1,6})\s+(.*?)\s*#*\s*$`)
+	mdRuleRe        = regexp.MustCompile(`^\s*([-*_])(\s*([-*_]))+\s*$`)
+	mdULItemRe      = regexp.MustCompile(`^\s*[-*+]\s+(.*)$`)
+	mdOLItemRe      = regexp.MustCompile(`^\s*\d+[.)]\s+(.*)$`)
+	mdLinkRe        = regexp.MustCompile(`\[([^\]]+)\]\(((?:[^()\s]|\([^()\s]*\))+)\)`) // URLs may have balanced parentheses
+	mdStrongRe      = regexp.MustCompile(`\*\*([^*]+)\*\*|__([^_]+)__`)
+	mdEmphasisRe    = regexp.MustCompile(`\*([^*]+)\*|\b_([^_]+)_\b`)
+	mdSafeURLPrefix = []string{"http://", "https://", "mailto:", "#", "/", "./", "../"}
+)
+
+// renderMarkdown converts a practical subset of Markdown into HTML.
+//
+// Supported: ATX headings, paragraphs, fenced code blocks, block quotes,
+// ordered/unordered lists, horizontal rules, and inline code, links, strong and emphasis.
+// All text is HTML-escaped.
+func renderMarkdown(src string) string {
+	src = strings.Replace(src, "\r\n", "\n", -1)
+	lines := strings.Split(src, "\n")
+
+	buff := new(strings.Builder)
+	var para []string
+
+	flushPara := func() {
+		if len(para) == 0 {
+			return
+		}
+		buff.WriteString("<p>")
+		buff.WriteString(renderMarkdownInline(strings.Join(para, "\n")))
+		buff.WriteString("</p>\n")
+		para = nil
+	}
+
+	for i := 0; i < len(lines); i++ {
+		line := lines[i]
+		trimmed := strings.TrimSpace(line)
+
+		switch {
+		case trimmed == "":
+			flushPara()
+
+		case strings.HasPrefix(trimmed, "```") || strings.HasPrefix(trimmed, "~~~"):
+			flushPara()
+			fence := trimmed[:3]
+			var code []string
+			for i++; i < len(lines) && !strings.HasPrefix(strings.TrimSpace(lines[i]), fence); i++ {
+				code = append(code, lines[i])
+			}
+			buff.WriteString("<pre><code>")
+			buff.WriteString(html.EscapeString(strings.Join(code, "\n")))
+			buff.WriteString("</code></pre>\n")
+
+		case mdHeadingRe.MatchString(trimmed):
+			flushPara()
+			m := mdHeadingRe.FindStringSubmatch(trimmed)
+			tag := "h" + string(rune('0'+len(m[1])))
+			buff.WriteString("<" + tag + ">" + renderMarkdownInline(m[2]) + "</" + tag + ">\n")
+
+		case mdRuleRe.MatchString(trimmed) && len(strings.Replace(trimmed, " ", "", -1)) >= 3:
+			flushPara()
+			buff.WriteString("<hr>\n")
+
+		case strings.HasPrefix(trimmed, ">"):
+			flushPara()
+			var quote []string
+			for ; i < len(lines) && strings.HasPrefix(strings.TrimSpace(lines[i]), ">"); i++ {
+				q := strings.TrimPrefix(strings.TrimSpace(lines[i]), ">")
+				quote = append(quote, strings.TrimPrefix(q, " "))
+			}
+			i--
+			buff.WriteString("<blockquote>\n")
+			buff.WriteString(renderMarkdown(strings.Join(quote, "\n")))
+			buff.WriteString("</blockquote>\n")
+
+		case mdULItemRe.MatchString(line) || mdOLItemRe.MatchString(line):
+			flushPara()
+			re, tag := mdULItemRe, "ul"
+			if !mdULItemRe.MatchString(line) {
+				re, tag = mdOLItemRe, "ol"
+			}
+			buff.WriteString("<" + tag + ">\n")
+			for ; i < len(lines) && re.MatchString(lines[i]); i++ {
+				buff.WriteString("<li>" + renderMarkdownInline(re.FindStringSubmatch(lines[i])[1]) + "</li>\n")
+			}
+			i--
+			buff.WriteString("</" + tag + ">\n")
+
+		default:
+			para = append(para, trimmed)
+		}
+	}
+	flushPara()
+
+	return buff.String()
+}
+
+// renderMarkdownInline escapes s and converts inline markups.
+// Code spans are left untouched by the other markups, and so are URLs of links.
+func renderMarkdownInline(s string) string {
+	buff := new(strings.Builder)
+
+	parts := strings.Split(s, "`")
+	for i, p := range parts {
+		if i%2 == 1 && i < len(parts)-1 {
+			buff.WriteString("<code>" + html.EscapeString(p) + "</code>")
+			continue
+		}
+		if i%2 == 1 {
+			// unbalanced backquote
+			buff.WriteString("`")
+		}
+
+		// links are put back after emphasis not to emphasize * and _ in their URLs
+		var links []string
+		p = html.EscapeString(p)
+		p = mdLinkRe.ReplaceAllStringFunc(p, func(m string) string {
+			sub := mdLinkRe.FindStringSubmatch(m)
+			if !isSafeMarkdownURL(html.UnescapeString(sub[2])) {
+				return sub[1]
+			}
+			links = append(links, `<a href="`+sub[2]+`">`+renderMarkdownEmphasis(sub[1])+`</a>`)
+			return mdLinkPlaceholder(len(links) - 1)
+		})
+		p = renderMarkdownEmphasis(p)
+		for i, link := range links {
+			p = strings.Replace(p, mdLinkPlaceholder(i), link, 1)
+		}
+		p = strings.Replace(p, "\n", "<br>\n", -1)
+
+		buff.WriteString(p)
+	}
+
+	return buff.String()
+}
+
+func renderMarkdownEmphasis(s string) string {
+	s = mdStrongRe.ReplaceAllString(s, "<strong>$1$2</strong>")
+	return mdEmphasisRe.ReplaceAllString(s, "<em>$1$2</em>")
+}
+
+// mdLinkPlaceholder stands for the i-th link of a span, having neither * nor _.
+func mdLinkPlaceholder(i int) string {
+	return "\x00" + strconv.Itoa(i) + "\x00"
+}
+
+func isSafeMarkdownURL(u string) bool {
+	lower := strings.ToLower(u)
+	for _, prefix := range mdSafeURLPrefix {
+		if strings.HasPrefix(lower, prefix) {
+			return true
+		}
+	}
+	// relative path without any scheme
+	return !strings.Contains(lower, ":")
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRenderMarkdown(t *testing.T) {
+	testdata := []struct {
+		Src  string
+		Want string
+	}{
+		{
+			Src:  "# 見出し\r\n\r\n本文です。\r\n2行目",
+			Want: "<h1>見出し</h1>\n<p>本文です。<br>\n2行目</p>\n",
+		},
+		{
+			Src:  "- a\n- **b**\n\n1. x\n2. `<y>`",
+			Want: "<ul>\n<li>a</li>\n<li><strong>b</strong></li>\n</ul>\n<ol>\n<li>x</li>\n<li><code>&lt;y&gt;</code></li>\n</ol>\n",
+		},
+		{
+			Src:  "```\n<script>\n```",
+			Want: "<pre><code>&lt;script&gt;</code></pre>\n",
+		},
+		{
+			Src:  "> quoted\n\n---",
+			Want: "<blockquote>\n<p>quoted</p>\n</blockquote>\n<hr>\n",
+		},
+		{
+			Src:  "[ok](https://example.com/?a=1&b=2) [ng](javascript:alert(1))",
+			Want: "<p><a href=\"https://example.com/?a=1&amp;b=2\">ok</a> ng</p>\n",
+		},
+		{
+			Src:  "[Go](https://en.wikipedia.org/wiki/Go_(programming_language)).",
+			Want: "<p><a href=\"https://en.wikipedia.org/wiki/Go_(programming_language)\">Go</a>.</p>\n",
+		},
+		{
+			Src:  "*see* [**a_b**](https://example.com/a_b_c/*x*) and [c](https://example.com/__d__)_",
+			Want: "<p><em>see</em> <a href=\"https://example.com/a_b_c/*x*\"><strong>a_b</strong></a> and <a href=\"https://example.com/__d__\">c</a>_</p>\n",
+		},
+	}
+
+	for _, d := range testdata {
+		got := renderMarkdown(d.Src)
+		if got != d.Want {
+			t.Errorf("renderMarkdown(%q):\n got %q\nwant %q", d.Src, got, d.Want)
+		}
+	}
+}
+
+func TestRenderMarkdownEscapes(t *testing.T) {
+	got := renderMarkdown("<b>bold</b> & *em*")
+	if strings.Contains(got, "<b>") {
+		t.Errorf("raw html is not escaped: %q", got)
+	}
+	if !strings.Contains(got, "<em>em</em>") {
+		t.Errorf("emphasis is not rendered: %q", got)
+	}
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/shu-go/imapclient"
+)
+
+// Bodies of a message having both text/plain and text/html.
+const (
+	bodyPlain = "plain"
+	bodyHTML  = "html" // converted to text
+)
+
+func normalizeBodyType(name string) (string, error) {
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case "", "plain", "text", "text/plain":
+		return bodyPlain, nil
+	case "html", "text/html":
+		return bodyHTML, nil
+	}
+	return "", fmt.Errorf("unsupported body %q (plain, html)", name)
+}
+
+// messageParts is the parts of a message sorted out.
+type messageParts struct {
+	Plain  *mail.Message
+	HTML   *mail.Message
+	Others []*mail.Message // attachments and inline parts other than the body
+}
+
+func sortParts(msgs []*mail.Message) messageParts {
+	var p messageParts
+	for _, m := range msgs {
+		mt := mediaTypeOf(m)
+		disp, _, _ := mime.ParseMediaType(m.Header.Get("Content-Disposition"))
+		attached := strings.ToLower(disp) == "attachment"
+
+		switch {
+		case !attached && mt == "text/plain" && p.Plain == nil:
+			p.Plain = m
+		case !attached && mt == "text/html" && p.HTML == nil:
+			p.HTML = m
+		default:
+			p.Others = append(p.Others, m)
+		}
+	}
+	return p
+}
+
+// mediaTypeOf returns the media type of a part in lower case. A part without Content-Type is text/plain.
+func mediaTypeOf(m *mail.Message) string {
+	ct := m.Header.Get("Content-Type")
+	if ct == "" {
+		return "text/plain"
+	}
+	mt, _, err := mime.ParseMediaType(ct)
+	if err != nil {
+		// e.g. a broken parameter
+		mt = strings.TrimSpace(strings.SplitN(ct, ";", 2)[0])
+	}
+	return strings.ToLower(mt)
+}
+
+// decodedMessage is a message decoded to be written as a memo.
+type decodedMessage struct {
+	Text        *mail.Message
+	HTMLOnly    bool
+	Attachments []*mail.Message
+}
+
+// decodeMessage decodes msg and picks up its body: text/plain, or text/html if body is bodyHTML or there is no text/plain.
+// HTML is converted into text unless rawHTML.
+// Non-text parts are returned as Attachments.
+func decodeMessage(msg *mail.Message, header bool, body string, rawHTML bool) (*decodedMessage, error) {
+	decodedMsg, err := imapclient.DecodeMailMessage(msg, header)
+	if err != nil {
+		// try to refer headers
+		headerMsg, herr := imapclient.DecodeMailMessage(msg, true)
+		if herr != nil {
+			return nil, herr
+		}
+		decodedHeaderMsg := pickupTextPartMessage(headerMsg)
+		return nil, fmt.Errorf("on subject[%v]: %v", decodedHeaderMsg.Header.Get("Subject"), err)
+	}
+	if len(decodedMsg) == 0 {
+		return nil, fmt.Errorf("no decodable messages found on subject[%v]", msg.Header.Get("Subject"))
+	}
+
+	textMsg := pickupTextPartMessage(decodedMsg)
+	if textMsg == nil {
+		return nil, fmt.Errorf("no text part found on subject[%v]", decodedMsg[0].Header.Get("Subject"))
+	}
+
+	dm := &decodedMessage{Text: textMsg}
+	if len(decodedMsg) == 1 {
+		dm.HTMLOnly = mediaTypeOf(textMsg) == "text/html"
+	} else {
+		p := sortParts(decodedMsg)
+		dm.HTMLOnly = p.Plain == nil && p.HTML != nil
+		if body == bodyHTML && p.HTML != nil && p.Plain != nil {
+			dm.Text = p.HTML
+		}
+		for _, m := range p.Others {
+			if m != textMsg && !strings.HasPrefix(mediaTypeOf(m), "multipart/") {
+				dm.Attachments = append(dm.Attachments, m)
+			}
+		}
+	}
+
+	if err := decodeLegacyCharset(dm.Text); err != nil {
+		return nil, err
+	}
+	if !header && !rawHTML && mediaTypeOf(dm.Text) == "text/html" {
+		if dm.Text, err = htmlPartAsText(dm.Text); err != nil {
+			return nil, err
+		}
+	}
+
+	return dm, nil
+}
+
+// htmlPartAsText converts an HTML part into a text/plain one.
+func htmlPartAsText(m *mail.Message) (*mail.Message, error) {
+	data, err := ioutil.ReadAll(m.Body)
+	if err != nil {
+		return nil, fmt.Errorf("on subject[%v]: body reading error: %v", m.Header.Get("Subject"), err)
+	}
+
+	header := make(mail.Header)
+	for k, v := range m.Header {
+		header[k] = v
+	}
+	header["Content-Type"] = []string{"text/plain; charset=\"utf-8\""}
+	delete(header, "Content-Transfer-Encoding")
+
+	return &mail.Message{Header: header, Body: strings.NewReader(htmlToText(string(data)))}, nil
+}
+
+// reportParts tells what is not in the body of dm, and saves its attachments in dir if set.
+func reportParts(dm *decodedMessage, dir string) error {
+	subject := dm.Text.Header.Get("Subject")
+
+	if dm.HTMLOnly {
+		if mediaTypeOf(dm.Text) == "text/html" {
+			logInfo("html only", "subject", subject)
+			fmt.Fprintf(os.Stderr, "%v: HTML only, kept as is\n", subject)
+		} else {
+			logInfo("html only", "subject", subject, "converted", true)
+			fmt.Fprintf(os.Stderr, "%v: HTML only, converted to text\n", subject)
+		}
+	}
+
+	if len(dm.Attachments) == 0 {
+		return nil
+	}
+	if dir == "" {
+		logInfo("attachments not saved", "subject", subject, "count", len(dm.Attachments))
+		fmt.Fprintf(os.Stderr, "%v: %d attachment(s) not saved (--attachments DIR)\n", subject, len(dm.Attachments))
+		return nil
+	}
+
+	names, err := saveAttachments(filepath.Join(dir, sanitizeFilename(subject, "untitled")), dm.Attachments)
+	for _, name := range names {
+		logInfo("attachment saved", "subject", subject, "file", name)
+	}
+	if err != nil {
+		return fmt.Errorf("on subject[%v]: %v", subject, err)
+	}
+	return nil
+}
+
+// saveAttachments writes parts into dir with their filenames, and returns the paths written.
+// A file with the same content is left as is.
+func saveAttachments(dir string, parts []*mail.Message) ([]string, error) {
+	if err := os.MkdirAll(dir, os.ModeDir|0755); err != nil {
+		return nil, err
+	}
+
+	var written []string
+	used := make(map[string]bool)
+	for i, p := range parts {
+		name := uniqueFilename(attachmentFilename(p, i+1), used)
+		used[strings.ToLower(name)] = true
+
+		data, err := ioutil.ReadAll(p.Body)
+		if err != nil {
+			return written, fmt.Errorf("%v: body reading error: %v", name, err)
+		}
+
+		path := filepath.Join(dir, name)
+		if current, err := ioutil.ReadFile(path); err == nil && bytes.Equal(current, data) {
+			continue
+		}
+		if err := ioutil.WriteFile(path, data, 0644); err != nil {
+			return written, err
+		}
+		written = append(written, path)
+	}
+	return written, nil
+}
+
+// attachmentFilename returns the filename of the n-th attachment p.
+func attachmentFilename(p *mail.Message, n int) string {
+	var name string
+	if _, params, err := mime.ParseMediaType(p.Header.Get("Content-Disposition")); err == nil {
+		name = params["filename"]
+	}
+	if name == "" {
+		if _, params, err := mime.ParseMediaType(p.Header.Get("Content-Type")); err == nil {
+			name = params["name"]
+		}
+	}
+	if decoded, err := mimeWordDecoder.DecodeHeader(name); err == nil {
+		name = decoded
+	}
+
+	fallback := fmt.Sprintf("part%d", n)
+	if exts, err := mime.ExtensionsByType(mediaTypeOf(p)); err == nil && len(exts) > 0 {
+		fallback += exts[0]
+	}
+	return sanitizeFilename(name, fallback)
+}
+
+// sanitizeFilename makes name safe as a filename on any platform, or returns fallback if nothing is left.
+func sanitizeFilename(name, fallback string) string {
+	name = filepath.Base(strings.Replace(name, "\\", "/", -1))
+	name = strings.Map(func(r rune) rune {
+		if r < 0x20 || strings.ContainsRune(`/\:*?"<>|`, r) {
+			return '_'
+		}
+		return r
+	}, name)
+	name = strings.TrimSpace(name)
+	if name == "" || name == "." || name == ".." {
+		return fallback
+	}
+	return name
+}
+
+// uniqueFilename returns name, or "name (2).ext" and so on if used (lower case) has it.
+func uniqueFilename(name string, used map[string]bool) string {
+	if !used[strings.ToLower(name)] {
+		return name
+	}
+
+	ext := filepath.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	for i := 2; ; i++ {
+		candidate := fmt.Sprintf("%s (%d)%s", base, i, ext)
+		if !used[strings.ToLower(candidate)] {
+			return candidate
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func newPart(contentType, disposition, body string) *mail.Message {
+	h := mail.Header{"Subject": []string{"memo"}}
+	if contentType != "" {
+		h["Content-Type"] = []string{contentType}
+	}
+	if disposition != "" {
+		h["Content-Disposition"] = []string{disposition}
+	}
+	return &mail.Message{Header: h, Body: strings.NewReader(body)}
+}
+
+func TestSortParts(t *testing.T) {
+	html := newPart("text/html; charset=utf-8", "", "<p>hi</p>")
+	plain := newPart("text/plain; charset=utf-8", "", "hi")
+	attachedText := newPart("text/plain", "attachment; filename=a.txt", "a")
+	image := newPart("image/png; name=b.png", "", "png")
+
+	msgs := []*mail.Message{html, attachedText, plain, image}
+	p := sortParts(msgs)
+	if p.Plain != plain || p.HTML != html || len(p.Others) != 2 || p.Others[0] != attachedText || p.Others[1] != image {
+		t.Errorf("sortParts = %+v", p)
+	}
+
+	if got := pickupTextPartMessage(msgs); got != plain {
+		t.Errorf("pickup: %v", got.Header)
+	}
+	if got := pickupTextPartMessage([]*mail.Message{image, html}); got != html {
+		t.Errorf("pickup html: %v", got.Header)
+	}
+	if got := pickupTextPartMessage([]*mail.Message{image, newPart("application/pdf", "", "")}); got == image {
+		t.Errorf("pickup fallback: %v", got.Header)
+	}
+}
+
+func TestAttachmentFilename(t *testing.T) {
+	cases := []struct {
+		part *mail.Message
+		name string
+	}{
+		{newPart("image/png", `attachment; filename="photo.png"`, ""), "photo.png"},
+		{newPart(`image/png; name="inline.png"`, "inline", ""), "inline.png"},
+		{newPart("image/png", "attachment; filename*=UTF-8''%E5%86%99%E7%9C%9F.png", ""), "写真.png"},
+		{newPart("image/png", `attachment; filename="=?UTF-8?B?5YaZ55yfLnBuZw==?="`, ""), "写真.png"},
+		{newPart("application/octet-stream", `attachment; filename="..\..\evil:name?.bin"`, ""), "evil_name_.bin"},
+		{newPart("application/x-unknown-type", "attachment", ""), "part3"},
+	}
+	for _, c := range cases {
+		if got := attachmentFilename(c.part, 3); got != c.name {
+			t.Errorf("%v: %q", c.part.Header, got)
+		}
+	}
+
+	used := map[string]bool{"a.png": true, "a (2).png": true}
+	if got := uniqueFilename("A.png", used); got != "A (3).png" {
+		t.Errorf("uniqueFilename: %q", got)
+	}
+}
+
+func TestSaveAttachments(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pomi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	parts := func() []*mail.Message {
+		return []*mail.Message{
+			newPart("image/png", `attachment; filename="a.png"`, "one"),
+			newPart("image/png", `attachment; filename="a.png"`, "two"),
+		}
+	}
+
+	written, err := saveAttachments(dir, parts())
+	if err != nil || len(written) != 2 {
+		t.Fatalf("saveAttachments = %v, %v", written, err)
+	}
+	for name, content := range map[string]string{"a.png": "one", "a (2).png": "two"} {
+		data, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil || string(data) != content {
+			t.Errorf("%v: %q, %v", name, data, err)
+		}
+	}
+
+	written, err = saveAttachments(dir, parts())
+	if err != nil || len(written) != 0 {
+		t.Errorf("again: %v, %v", written, err)
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestNewTemplate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pomi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "会議.md"), []byte("# {{.Subject}}\n第{{.Counter}}回 {{.Date}} {{.User}}\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	name, err := findTemplate(dir, "会議")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filepath.Ext(name) != ".md" {
+		t.Errorf("wrong template %v", name)
+	}
+	if _, err := findTemplate(dir, "日報"); err == nil {
+		t.Errorf("missing template must fail")
+	}
+
+	counters, err := loadCounters(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	counters["会議"]++
+	if err := saveCounters(dir, counters); err != nil {
+		t.Fatal(err)
+	}
+	if counters, err = loadCounters(dir); err != nil || counters["会議"] != 1 {
+		t.Errorf("wrong counters %v: %v", counters, err)
+	}
+
+	src, _ := ioutil.ReadFile(name)
+	vars := templateVars{
+		Subject: "定例",
+		Date:    "2024-06-01",
+		User:    "pomi",
+		Counter: 2,
+		Now:     time.Now(),
+	}
+	got, err := renderTemplate("会議", string(src), vars)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "# 定例\n第2回 2024-06-01 pomi\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
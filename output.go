@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/mail"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+var listColumns = []string{"seq", "uid", "subject", "date", "ext", "size", "flags", "tags"}
+
+// writeList writes list in format (text, long, json, jsonl, csv or tsv), or by a text/template over listElement.
+//
+// text is the same as ever for scripts; long adds the labels of flags and the tags to it.
+func writeList(w io.Writer, list []listElement, format, tmpl string) error {
+	if tmpl != "" {
+		t, err := template.New("list").Funcs(template.FuncMap{"join": strings.Join}).Parse(tmpl)
+		if err != nil {
+			return fmt.Errorf("template error: %v", err)
+		}
+		for _, e := range list {
+			if err := t.Execute(w, e); err != nil {
+				return fmt.Errorf("template error: %v", err)
+			}
+			if !strings.HasSuffix(tmpl, "\n") {
+				fmt.Fprintln(w)
+			}
+		}
+		return nil
+	}
+
+	switch format {
+	case "", "text":
+		for _, e := range list {
+			fmt.Fprintf(w, "%d %v (%v)\n", e.Seq, e.Subject, e.Date)
+		}
+
+	case "long":
+		for _, e := range list {
+			line := fmt.Sprintf("%d %v (%v)", e.Seq, e.Subject, e.Date)
+			if labels := flagLabels(e.Flags); len(labels) > 0 {
+				line += fmt.Sprintf(" {%v}", strings.Join(labels, ", "))
+			}
+			if len(e.Tags) > 0 {
+				line += fmt.Sprintf(" [%v]", strings.Join(e.Tags, ", "))
+			}
+			fmt.Fprintln(w, line)
+		}
+
+	case "json":
+		if list == nil {
+			list = []listElement{}
+		}
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(list)
+
+	case "jsonl":
+		enc := json.NewEncoder(w)
+		for _, e := range list {
+			if err := enc.Encode(e); err != nil {
+				return err
+			}
+		}
+
+	case "csv":
+		cw := csv.NewWriter(w)
+		cw.Write(listColumns)
+		for _, e := range list {
+			cw.Write(listRecord(e))
+		}
+		cw.Flush()
+		return cw.Error()
+
+	case "tsv":
+		// no quoting; tabs and newlines in values are replaced with spaces
+		escape := strings.NewReplacer("\t", " ", "\r", " ", "\n", " ")
+		fmt.Fprintln(w, strings.Join(listColumns, "\t"))
+		for _, e := range list {
+			rec := listRecord(e)
+			for i := range rec {
+				rec[i] = escape.Replace(rec[i])
+			}
+			fmt.Fprintln(w, strings.Join(rec, "\t"))
+		}
+
+	default:
+		return fmt.Errorf("unsupported format %q", format)
+	}
+
+	return nil
+}
+
+func listRecord(e listElement) []string {
+	return []string{
+		strconv.FormatUint(uint64(e.Seq), 10),
+		strconv.FormatUint(uint64(e.UID), 10),
+		e.Subject,
+		e.Date,
+		e.Ext,
+		strconv.Itoa(e.Size),
+		strings.Join(e.Flags, " "),
+		strings.Join(e.Tags, ", "),
+	}
+}
+
+type shownMessage struct {
+	Seq    uint32              `json:"seq"`
+	Header map[string][]string `json:"header"`
+	Body   string              `json:"body"`
+}
+
+// writeMessagesJSON writes messages in seq as a JSON array (json) or as JSON lines (jsonl).
+func writeMessagesJSON(ic *imapConn, seq, format string, w io.Writer) error {
+	if format != "json" && format != "jsonl" {
+		return fmt.Errorf("unsupported format %q", format)
+	}
+
+	var mm map[uint32]*mail.Message
+	if seq != "" {
+		var err error
+		mm, err = ic.Fetch(seq)
+		if err != nil {
+			return err
+		}
+	}
+
+	seqs := make([]uint32, 0, len(mm))
+	for s := range mm {
+		seqs = append(seqs, s)
+	}
+	sort.Slice(seqs, func(i, j int) bool {
+		return seqs[i] < seqs[j]
+	})
+
+	shown := make([]shownMessage, 0, len(mm))
+	for _, s := range seqs {
+		textMsg, err := decodeMessageAsTextMessage(mm[s], false)
+		if err != nil {
+			return err
+		}
+
+		body, err := ioutil.ReadAll(textMsg.Body)
+		if err != nil {
+			return fmt.Errorf("on subject[%v]: body reading error: %v", textMsg.Header.Get("Subject"), err)
+		}
+
+		shown = append(shown, shownMessage{
+			Seq:    s,
+			Header: textMsg.Header,
+			Body:   string(bytes.TrimPrefix(body, utf8BOM)),
+		})
+	}
+
+	enc := json.NewEncoder(w)
+	if format == "jsonl" {
+		for _, m := range shown {
+			if err := enc.Encode(m); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	enc.SetIndent("", "  ")
+	return enc.Encode(shown)
+}
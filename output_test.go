@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestWriteList(t *testing.T) {
+	list := []listElement{
+		{Seq: 1, UID: 101, Subject: "会議 (定例)", Date: "Mon, 03 Jun 2024 10:00:00 +0900", Ext: "md", Size: 12, Flags: []string{`\Seen`, `\Flagged`}, Tags: []string{"work", "仕事"}},
+		{Seq: 2, UID: 105, Subject: "a,\"b\"\tc", Date: "Tue, 04 Jun 2024 10:00:00 +0900"},
+	}
+
+	testdata := []struct {
+		Format   string
+		Template string
+		Want     string
+	}{
+		{
+			Format: "jsonl",
+			Want: `{"seq":1,"uid":101,"subject":"会議 (定例)","date":"Mon, 03 Jun 2024 10:00:00 +0900","ext":"md","size":12,"flags":["\\Seen","\\Flagged"],"tags":["work","仕事"]}
+{"seq":2,"uid":105,"subject":"a,\"b\"\tc","date":"Tue, 04 Jun 2024 10:00:00 +0900","ext":"","size":0,"flags":null}
+`,
+		},
+		{
+			Format: "csv",
+			Want: "seq,uid,subject,date,ext,size,flags,tags\n" +
+				"1,101,会議 (定例),\"Mon, 03 Jun 2024 10:00:00 +0900\",md,12,\\Seen \\Flagged,\"work, 仕事\"\n" +
+				"2,105,\"a,\"\"b\"\"\tc\",\"Tue, 04 Jun 2024 10:00:00 +0900\",,0,,\n",
+		},
+		{
+			Format: "tsv",
+			Want: "seq\tuid\tsubject\tdate\text\tsize\tflags\ttags\n" +
+				"1\t101\t会議 (定例)\tMon, 03 Jun 2024 10:00:00 +0900\tmd\t12\t\\Seen \\Flagged\twork, 仕事\n" +
+				"2\t105\ta,\"b\" c\tTue, 04 Jun 2024 10:00:00 +0900\t\t0\t\t\n",
+		},
+		{
+			Format: "text",
+			Want: "1 会議 (定例) (Mon, 03 Jun 2024 10:00:00 +0900)\n" +
+				"2 a,\"b\"\tc (Tue, 04 Jun 2024 10:00:00 +0900)\n",
+		},
+		{
+			Format: "long",
+			Want: "1 会議 (定例) (Mon, 03 Jun 2024 10:00:00 +0900) {pinned} [work, 仕事]\n" +
+				"2 a,\"b\"\tc (Tue, 04 Jun 2024 10:00:00 +0900)\n",
+		},
+		{
+			Template: `{{.UID}} {{.Subject}}:{{join .Flags ","}}`,
+			Want:     "101 会議 (定例):\\Seen,\\Flagged\n105 a,\"b\"\tc:\n",
+		},
+	}
+
+	for _, d := range testdata {
+		buff := new(bytes.Buffer)
+		if err := writeList(buff, list, d.Format, d.Template); err != nil {
+			t.Errorf("writeList(%q, %q): %v", d.Format, d.Template, err)
+		} else if buff.String() != d.Want {
+			t.Errorf("writeList(%q, %q):\n got %q\nwant %q", d.Format, d.Template, buff.String(), d.Want)
+		}
+	}
+
+	if err := writeList(new(bytes.Buffer), list, "xml", ""); err == nil {
+		t.Errorf("unsupported format must fail")
+	}
+}
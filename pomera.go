@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding/japanese"
+	"golang.org/x/text/transform"
+)
+
+// Defaults of [POMERA]. Adjust them to the model in the config.
+const (
+	defaultPomeraMaxBodyChars    = 8000
+	defaultPomeraMaxSubjectChars = 64
+	defaultPomeraSubstitute      = "〓"
+)
+
+const (
+	policyOff   = "off"
+	policyWarn  = "warn"
+	policyBlock = "block"
+	policyFix   = "fix"
+)
+
+// pomeraPolicy checks memos against what the Pomera can handle before they are put.
+type pomeraPolicy struct {
+	Policy          string
+	MaxBodyChars    int // 0 for unlimited
+	MaxSubjectChars int // 0 for unlimited
+	MaxMemos        int // 0 for unlimited
+	Substitute      string
+}
+
+// pomeraPolicyOf returns [POMERA] of the config with defaults filled. flag overrides Policy.
+func pomeraPolicyOf(config *config, flag string) (pomeraPolicy, error) {
+	p := pomeraPolicy{
+		Policy:          strings.ToLower(config.POMERA.Policy),
+		MaxBodyChars:    config.POMERA.MaxBodyChars,
+		MaxSubjectChars: config.POMERA.MaxSubjectChars,
+		MaxMemos:        config.POMERA.MaxMemos,
+		Substitute:      config.POMERA.Substitute,
+	}
+	if flag != "" {
+		p.Policy = strings.ToLower(flag)
+	}
+
+	switch p.Policy {
+	case "":
+		p.Policy = policyOff
+	case policyOff, policyWarn, policyBlock, policyFix:
+	default:
+		return p, fmt.Errorf("unknown policy %q (off, warn, block, fix)", p.Policy)
+	}
+
+	if p.MaxBodyChars == 0 {
+		p.MaxBodyChars = defaultPomeraMaxBodyChars
+	}
+	if p.MaxSubjectChars == 0 {
+		p.MaxSubjectChars = defaultPomeraMaxSubjectChars
+	}
+	if p.Substitute == "" {
+		p.Substitute = defaultPomeraSubstitute
+	}
+
+	// negative values turn the checks off
+	if p.MaxBodyChars < 0 {
+		p.MaxBodyChars = 0
+	}
+	if p.MaxSubjectChars < 0 {
+		p.MaxSubjectChars = 0
+	}
+	if p.MaxMemos < 0 {
+		p.MaxMemos = 0
+	}
+
+	return p, nil
+}
+
+// validationError lists what the Pomera cannot handle in a memo.
+type validationError []string
+
+func (e validationError) Error() string {
+	return "pomera: " + strings.Join(e, "; ")
+}
+
+// check validates a memo and returns the body to be put.
+//
+// With warn, problems are returned as a validationError along with body as is; the caller warns and puts it.
+// With fix, unrenderable characters in the body are substituted first, and the remaining problems are warned.
+// With block, problems are returned as errSkipped and the body is nil.
+func (p pomeraPolicy) check(subject string, body []byte) ([]byte, error) {
+	if p.Policy == policyOff {
+		return body, nil
+	}
+
+	var problems validationError
+
+	if p.Policy == policyFix {
+		var n int
+		body, n = substituteUnrenderable(body, p.Substitute)
+		if n > 0 {
+			logInfo("substituted characters", "subject", subject, "count", n)
+		}
+	}
+
+	if p.MaxSubjectChars > 0 {
+		if n := utf8.RuneCountInString(subject); n > p.MaxSubjectChars {
+			problems = append(problems, fmt.Sprintf("subject is %d characters (max %d)", n, p.MaxSubjectChars))
+		}
+	}
+	if bad := unrenderableRunes(subject); len(bad) > 0 {
+		problems = append(problems, fmt.Sprintf("subject has characters the Pomera can't show: %v", quoteRunes(bad)))
+	}
+
+	if p.MaxBodyChars > 0 {
+		if n := utf8.RuneCount(bytes.TrimPrefix(body, utf8BOM)); n > p.MaxBodyChars {
+			problems = append(problems, fmt.Sprintf("body is %d characters (max %d)", n, p.MaxBodyChars))
+		}
+	}
+	if bad := unrenderableRunes(string(body)); len(bad) > 0 {
+		problems = append(problems, fmt.Sprintf("body has characters the Pomera can't show: %v", quoteRunes(bad)))
+	}
+
+	if len(problems) == 0 {
+		return body, nil
+	}
+	if p.Policy == policyBlock {
+		return nil, errSkipped{problems.Error()}
+	}
+	return body, problems
+}
+
+// checkMemoCount validates the number of memos after newMemos are added to existing ones.
+func (p pomeraPolicy) checkMemoCount(existing, newMemos int) error {
+	if p.Policy == policyOff || p.MaxMemos <= 0 || existing+newMemos <= p.MaxMemos {
+		return nil
+	}
+	return validationError{fmt.Sprintf("the box will have %d memos (max %d)", existing+newMemos, p.MaxMemos)}
+}
+
+// isRenderable reports whether the Pomera can show r.
+// The Pomera fonts cover JIS X 0208 (what Shift_JIS can encode), so emoji and many symbols are not.
+func isRenderable(r rune) bool {
+	switch {
+	case r == '\t' || r == '\r' || r == '\n' || r == '\ufeff':
+		return true
+	case r < 0x20 || r == 0x7f:
+		return false
+	case r < 0x7f:
+		return true
+	}
+
+	_, _, err := transform.String(japanese.ShiftJIS.NewEncoder(), string(r))
+	return err == nil
+}
+
+// unrenderableRunes returns distinct runes in s that the Pomera can't show, in order of appearance.
+func unrenderableRunes(s string) []rune {
+	var bad []rune
+	seen := make(map[rune]bool)
+	for _, r := range s {
+		if !isRenderable(r) && !seen[r] {
+			seen[r] = true
+			bad = append(bad, r)
+		}
+	}
+	return bad
+}
+
+// substituteUnrenderable replaces runes the Pomera can't show with sub, and returns the count.
+func substituteUnrenderable(data []byte, sub string) ([]byte, int) {
+	s := string(data)
+	if len(unrenderableRunes(s)) == 0 {
+		return data, 0
+	}
+
+	n := 0
+	buff := new(bytes.Buffer)
+	for _, r := range s {
+		if isRenderable(r) {
+			buff.WriteRune(r)
+		} else {
+			buff.WriteString(sub)
+			n++
+		}
+	}
+	return buff.Bytes(), n
+}
+
+func quoteRunes(rs []rune) string {
+	const max = 5
+
+	ss := make([]string, 0, max+1)
+	for i, r := range rs {
+		if i == max {
+			ss = append(ss, fmt.Sprintf("and %d more", len(rs)-max))
+			break
+		}
+		ss = append(ss, fmt.Sprintf("%q (U+%04X)", r, r))
+	}
+	return strings.Join(ss, ", ")
+}
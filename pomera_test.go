@@ -0,0 +1,93 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPomeraPolicyCheck(t *testing.T) {
+	base := pomeraPolicy{MaxBodyChars: 10, MaxSubjectChars: 5, Substitute: "〓"}
+
+	// fine
+	for _, policy := range []string{policyWarn, policyBlock, policyFix} {
+		p := base
+		p.Policy = policy
+		if body, err := p.check("memo", []byte("ポメラ ok")); err != nil || string(body) != "ポメラ ok" {
+			t.Errorf("%v: %q, %v", policy, body, err)
+		}
+	}
+
+	body := []byte("絵文字😀")
+
+	p := base
+	p.Policy = policyWarn
+	got, err := p.check("memo", body)
+	if _, ok := err.(validationError); !ok || string(got) != string(body) {
+		t.Errorf("warn: %q, %v", got, err)
+	}
+
+	p.Policy = policyBlock
+	got, err = p.check("memo", body)
+	if _, ok := err.(errSkipped); !ok || got != nil {
+		t.Errorf("block: %q, %v", got, err)
+	}
+
+	p.Policy = policyFix
+	got, err = p.check("memo", body)
+	if err != nil || string(got) != "絵文字〓" {
+		t.Errorf("fix: %q, %v", got, err)
+	}
+
+	// fix can't shorten
+	got, err = p.check("long subject", []byte("0123456789ab"))
+	if err == nil || !strings.Contains(err.Error(), "subject is 12") || !strings.Contains(err.Error(), "body is 12") {
+		t.Errorf("fix long: %q, %v", got, err)
+	}
+
+	p.Policy = policyOff
+	if _, err := p.check("long subject 😀", body); err != nil {
+		t.Errorf("off: %v", err)
+	}
+}
+
+func TestPomeraPolicyOf(t *testing.T) {
+	config := &config{}
+	p, err := pomeraPolicyOf(config, "")
+	if err != nil || p.Policy != policyOff || p.MaxBodyChars != defaultPomeraMaxBodyChars {
+		t.Errorf("default: %+v, %v", p, err)
+	}
+
+	config.POMERA.Policy = "Warn"
+	if p, err := pomeraPolicyOf(config, ""); err != nil || p.Policy != policyWarn {
+		t.Errorf("config: %+v, %v", p, err)
+	}
+	if p, err := pomeraPolicyOf(config, "block"); err != nil || p.Policy != policyBlock {
+		t.Errorf("flag: %+v, %v", p, err)
+	}
+	if _, err := pomeraPolicyOf(config, "strict"); err == nil {
+		t.Errorf("strict must fail")
+	}
+}
+
+func TestPomeraPolicyMemoCount(t *testing.T) {
+	p := pomeraPolicy{Policy: policyWarn, MaxMemos: 10}
+	if err := p.checkMemoCount(8, 2); err != nil {
+		t.Error(err)
+	}
+	if err := p.checkMemoCount(8, 3); err == nil {
+		t.Error("11 memos should be over")
+	}
+}
+
+func TestIsRenderable(t *testing.T) {
+	for _, r := range "aZ09 \t\n「」ー～①漢ひカ" {
+		if !isRenderable(r) {
+			t.Errorf("%q should be renderable", r)
+		}
+	}
+	for _, r := range "😀☃\x07" {
+		if isRenderable(r) {
+			t.Errorf("%q should not be renderable", r)
+		}
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
@@ -9,6 +10,7 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/mail"
+	"net/textproto"
 	"net/url"
 	"os"
 	"path/filepath"
@@ -46,6 +48,43 @@ type config struct {
 
 		RefreshToken string `toml:"RefreshToken,omitempty"`
 	}
+	POMERA struct {
+		Policy          string `toml:"Policy,omitempty"`
+		MaxBodyChars    int    `toml:"MaxBodyChars,omitempty"`
+		MaxSubjectChars int    `toml:"MaxSubjectChars,omitempty"`
+		MaxMemos        int    `toml:"MaxMemos,omitempty"`
+		Substitute      string `toml:"Substitute,omitempty"`
+	}
+	LOCAL struct {
+		Encoding   string `toml:"Encoding,omitempty"`
+		LineEnding string `toml:"LineEnding,omitempty"`
+		StripBOM   bool   `toml:"StripBOM,omitempty"`
+	}
+	INDEX struct {
+		Path string `toml:"Path,omitempty"`
+	}
+	TEMPLATE struct {
+		Dir string `toml:"Dir,omitempty"`
+	}
+	TIMEOUT struct {
+		Dial    int `toml:"Dial,omitempty"`
+		Command int `toml:"Command,omitempty"`
+		HTTP    int `toml:"HTTP,omitempty"`
+		Total   int `toml:"Total,omitempty"`
+	}
+	RETRY struct {
+		Attempts int `toml:"Attempts,omitempty"`
+		Wait     int `toml:"Wait,omitempty"`
+		MaxWait  int `toml:"MaxWait,omitempty"`
+	}
+	TAG struct {
+		Storage string `toml:"Storage,omitempty"`
+	}
+
+	path string
+
+	accessToken string
+	tokenMu     sync.Mutex
 }
 
 type oAuth2AuthedTokens struct {
@@ -68,12 +107,27 @@ type MsgWriter func(syncDirPath, subject, ext string, tm time.Time, r io.Reader)
 
 var filesWriter MsgWriter = func(syncDirPath, subject, ext string, tm time.Time, r io.Reader) error {
 	name := filepath.Join(syncDirPath, subject+"."+ext)
-	data, err := ioutil.ReadAll(r)
-	if err != nil {
-		return err
+
+	// leave the file as is if it has the same content and timestamp
+	if info, err := os.Stat(name); err == nil && info.ModTime().Equal(tm) {
+		data, err := ioutil.ReadAll(r)
+		if err != nil {
+			return fmt.Errorf("on subject[%v]: body reading error: %v", subject, err)
+		}
+		if current, err := ioutil.ReadFile(name); err == nil && bytes.Equal(current, data) {
+			return errUnchanged
+		}
+		r = bytes.NewReader(data)
 	}
 
-	err = ioutil.WriteFile(name, data, 0x600)
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0x600)
+	if err != nil {
+		return fmt.Errorf("on subject[%v]: failed to write to %q: %v\n", subject, name, err)
+	}
+	_, err = io.Copy(f, r)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
 	if err != nil {
 		return fmt.Errorf("on subject[%v]: failed to write to %q: %v\n", subject, name, err)
 	}
@@ -106,9 +160,34 @@ type globalCmd struct {
 	Get    getCmd    `cli:"get, g"  help:"get messages"`
 	Put    putCmd    `cli:"put, p"  help:"put messages"`
 	Delete deleteCmd `cli:"delete, del, d"  help:"delete messages"`
+	Export exportCmd `help:"export messages as a static site"`
+	New    newCmd    `cli:"new, n"  help:"put a new message from a template"`
+	Rename renameCmd `cli:"rename, mv"  help:"rename a message"`
+	Append appendCmd `cli:"append, a"  help:"append text to a message"`
+	Edit   editCmd   `cli:"edit, e"  help:"edit a message with $VISUAL or $EDITOR"`
+	Search searchCmd `cli:"search, find"  help:"search messages in the local index"`
+	Tag    tagCmd    `help:"tag messages (add, rm, ls)"`
+	Pin    pinCmd    `help:"pin messages (flag them on IMAP)"`
+	Unpin  unpinCmd  `help:"unpin messages"`
+	Mark   markCmd   `help:"mark messages as read or unread"`
 
 	Config string `cli:"config=CONFIG_FILE, conf"  default:"./pomi.toml"  help:"path to a configuration file"`
 	Dir    string `cli:"dir=DIR, d"  default:"./pomera_sync"  help:"path to a local directory"`
+
+	Verbose   bool   `cli:"verbose, V"  help:"log debug messages (to stderr unless --log-file or POMI_LOG)"`
+	Trace     bool   `help:"log IMAP commands and OAuth requests too (credentials are redacted)"`
+	LogFile   string `cli:"log-file=FILE"  help:"append logs to FILE (overrides POMI_LOG)"`
+	LogFormat string `cli:"log-format=FORMAT"  help:"log format (text, json)"`
+}
+
+// loadConfig starts logging as specified, and then loads the config file.
+func (g globalCmd) loadConfig() (*config, error) {
+	if err := setupLogging(g.Verbose, g.Trace, g.LogFile, g.LogFormat); err != nil {
+		return nil, err
+	}
+	logDebug("start", "version", Version, "args", os.Args[1:])
+
+	return loadConfig(g.Config)
 }
 
 func main() {
@@ -120,8 +199,12 @@ func main() {
 2. pomi get --all
 `
 	app.Copyright = "(C) 2017 Shuhei Kubota"
+
+	go handleInterrupt()
+
 	err := app.Run(os.Args)
 	if err != nil {
+		logError("exit", "err", err)
 		os.Exit(1)
 	}
 
@@ -149,6 +232,11 @@ func loadConfig(path string) (*config, error) {
 		}
 		fmt.Fprintf(os.Stderr, "created.\n")
 	}
+	config.path = path
+
+	addLogSecret(config.IMAP.Pass)
+	addLogSecret(config.AUTH.ClientSecret)
+	addLogSecret(config.AUTH.RefreshToken)
 
 	return config, nil
 }
@@ -161,34 +249,59 @@ func saveConfig(config *config, path string) error {
 	return ioutil.WriteFile(path, buf.Bytes(), 0700)
 }
 
-func initIMAP(config *config) (*imapclient.Client, error) {
-	c, err := connIMAP(config)
+// initIMAP connects, logs in and selects the box, retrying transient errors.
+func initIMAP(config *config) (*imapConn, error) {
+	return initIMAPContext(rootCtx, config)
+}
+
+func initIMAPContext(ctx context.Context, config *config) (*imapConn, error) {
+	var c *imapConn
+	err := retry(ctx, config, "connect", func() error {
+		var err error
+		c, err = openIMAP(ctx, config)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func openIMAP(ctx context.Context, config *config) (*imapConn, error) {
+	logDebug("connect", "server", config.IMAP.Server, "user", config.IMAP.User)
+
+	c, err := connIMAP(ctx, config)
 	if err != nil {
-		return nil, fmt.Errorf("failed to connect to %v: %v\n", config.IMAP.Server, err)
+		return nil, fmt.Errorf("failed to connect to %v: %v", config.IMAP.Server, err)
 	}
 
-	err = loginIMAP(c, config)
+	err = loginIMAP(ctx, c, config)
 	if err != nil {
-		return nil, fmt.Errorf("failed to log in to %v: %v\n", config.IMAP.Server, err)
+		c.Logout()
+		return nil, fmt.Errorf("failed to log in to %v: %v", config.IMAP.Server, err)
 	}
 
+	logTrace("imap", "cmd", "SELECT", "box", config.IMAP.Box)
 	err = c.Select(config.IMAP.Box)
 	if err != nil {
-		return nil, fmt.Errorf("can't select box %v: %v\n", config.IMAP.Box, err)
+		c.Logout()
+		return nil, fmt.Errorf("can't select box %v: %v", config.IMAP.Box, err)
 	}
 
 	return c, nil
 }
 
-func loginIMAP(c *imapclient.Client, config *config) error {
+func loginIMAP(ctx context.Context, c *imapConn, config *config) error {
 	loggedin := false
 
 	if config.AUTH.RefreshToken != "" {
-		accessToken, err := refreshAccessToken(config)
+		accessToken, err := config.getAccessToken(ctx)
 		if err == nil {
 			data := fmt.Sprintf("user=%s\001auth=Bearer %s\001\001", config.IMAP.User, accessToken)
 			am := base64.StdEncoding.EncodeToString([]byte(data))
 
+			addLogSecret(am)
+			logTrace("imap", "cmd", "AUTHENTICATE XOAUTH2 "+am, "user", config.IMAP.User)
 			err = c.Authenticate(fmt.Sprintf("XOAUTH2 %s", am))
 
 			loggedin = true
@@ -210,6 +323,8 @@ func loginIMAP(c *imapclient.Client, config *config) error {
 			config.IMAP.Pass = os.Getenv("IMAP_PASS")
 		}
 
+		addLogSecret(config.IMAP.Pass)
+		logTrace("imap", "cmd", fmt.Sprintf("LOGIN %v ***", config.IMAP.User))
 		err := c.Login(config.IMAP.User, config.IMAP.Pass)
 		if err != nil {
 			return fmt.Errorf("can't login as %v: %v\n", config.IMAP.User, err)
@@ -219,8 +334,12 @@ func loginIMAP(c *imapclient.Client, config *config) error {
 	return nil
 }
 
-func connIMAP(config *config) (*imapclient.Client, error) {
-	c, err := imapclient.NewClient("tcp", config.IMAP.Server)
+// connIMAP connects to the server. ctx cancels connecting,
+// while each command later is bounded by [TIMEOUT] Command, not by ctx,
+// so that a message being replaced is not cut off by an interrupt.
+func connIMAP(ctx context.Context, config *config) (*imapConn, error) {
+	t := config.timeouts()
+	c, err := dialIMAP(ctx, config.IMAP.Server, t.Dial, t.Command)
 	if err != nil {
 		return nil, fmt.Errorf("can't connect to %v: %v\n", config.IMAP.Server, err)
 	}
@@ -228,32 +347,65 @@ func connIMAP(config *config) (*imapclient.Client, error) {
 	return c, nil
 }
 
-func putMessage(c *imapclient.Client, box, from, subject, ext string, file *os.File, tm time.Time) error {
-	var m *mail.Message
+// putMessage appends a message and then deletes the other messages with the same subject.
+//
+// It is safe to call again after a failure: if the very message (same Date and body) is already in the box,
+// it is not appended twice.
+func putMessage(c *imapConn, box, from, subject, ext string, file io.Reader, tm time.Time) error {
+	err := putMessageUnlessUnchanged(c, box, from, subject, ext, nil, false, file, tm)
+	if err == errUnchanged {
+		return nil
+	}
+	return err
+}
+
+// putMessageUnlessUnchanged is putMessage, but returns errUnchanged if the message is already in the box.
+// extra headers are added to the message.
+// frontMatter tells that the front matter of the file is parsed into extra,
+// otherwise (edit, append, ...) the front matter headers of the message found are kept.
+func putMessageUnlessUnchanged(c *imapConn, box, from, subject, ext string, extra mail.Header, frontMatter bool, file io.Reader, tm time.Time) error {
+	found, err := findMessagesBySubject(c, subject)
+	if err != nil {
+		return err
+	}
 
-	seqs, err := c.Search("SUBJECT", subject)
-	msgmap, _ := c.Fetch(joinUint32(seqs, ","))
-	if err == nil && len(msgmap) > 0 {
-		for _, ref := range msgmap {
-			dref, err := imapclient.DecodeMailMessage(ref)
-			if err != nil {
-				continue
-			}
-			tref := pickupTextPartMessage(dref)
-			if tref == nil {
-				continue
-			}
+	m := newPutMessage(found, from, subject, ext, extra, frontMatter, tm)
+	date := m.Header.Get("Date")
 
-			if tref.Header.Get("Subject") == subject {
-				m = tref
-				break
-			}
+	//add BOM for pomera
+	var body []byte
+	{
+		buff := new(bytes.Buffer)
+		if all, err := ioutil.ReadAll(file); err == nil {
+			buff.Write(all)
+		}
+
+		if !bytes.HasPrefix(buff.Bytes(), utf8BOM) {
+			bombuff := bytes.NewBuffer(utf8BOM)
+			bombuff.Write(buff.Bytes())
+			buff = bombuff
 		}
+
+		body = buff.Bytes()
+		m.Body = buff
 	}
 
-	if m == nil {
-		m = new(mail.Message)
-		m.Header = make(mail.Header)
+	// an interrupt waits for the replacement
+	return critical(func() error {
+		return replaceMessage(c, box, subject, date, body, m, found)
+	})
+}
+
+// newPutMessage returns a message to be put without its body, reusing the headers of the newest of found if any.
+// See putMessageUnlessUnchanged for extra and frontMatter.
+func newPutMessage(found []foundMessage, from, subject, ext string, extra mail.Header, frontMatter bool, tm time.Time) *mail.Message {
+	m := &mail.Message{Header: make(mail.Header)}
+	if len(found) > 0 {
+		// a copy not to change the found one compared in replaceMessage
+		for k, v := range found[len(found)-1].Msg.Header {
+			m.Header[k] = v
+		}
+	} else {
 		m.Header["Subject"] = []string{subject}
 		m.Header["Content-Type"] = []string{"text/plain; charset=\"utf-8-sig\""}
 
@@ -264,271 +416,1068 @@ func putMessage(c *imapclient.Client, box, from, subject, ext string, file *os.F
 		m.Header["From"] = []string{from}
 	}
 
-	if m == nil {
-		return fmt.Errorf("miss initializing m")
-	}
-
 	m.Header["Date"] = []string{tm.Format(time.RFC1123Z)}
 	if len(ext) > 0 {
 		m.Header["X-Pomi-Ext"] = []string{ext}
 	}
+	delete(m.Header, partHeader)
+	delete(m.Header, parentHeader)
+	if frontMatter {
+		for k := range m.Header {
+			if isFrontMatterHeader(k) {
+				delete(m.Header, k)
+			}
+		}
+	}
+	for k, v := range extra {
+		m.Header[k] = v
+	}
 
-	//add BOM for pomera
-	{
-		buff := new(bytes.Buffer)
-		if all, err := ioutil.ReadAll(file); err == nil {
-			buff.Write(all)
+	return m
+}
+
+// replaceMessage appends m unless it is in found, and deletes the others.
+// It returns errUnchanged if m is not appended.
+func replaceMessage(c *imapConn, box, subject, date string, body []byte, m *mail.Message, found []foundMessage) error {
+	appended := false
+	for _, f := range found {
+		if sameDate(f.Msg.Header.Get("Date"), date) && bytes.Equal(f.Body, body) && samePomiHeaders(f.Msg.Header, m.Header) {
+			appended = true
+			break
 		}
+	}
 
-		if bytes.Index(buff.Bytes(), utf8BOM) == -1 {
-			bombuff := bytes.NewBuffer(utf8BOM)
-			bombuff.Write(buff.Bytes())
-			buff = bombuff
+	if !appended {
+		m, err := imapclient.EncodeMailMessage(m)
+		if err != nil {
+			return fmt.Errorf("message encode error of %q: %v", subject, err)
 		}
 
-		m.Body = buff
+		// append first not to lose the message on failure
+		logTrace("imap", "cmd", "APPEND", "box", box, "subject", subject, "size", len(body))
+		err = c.Append(box, carriedFlags(c, found), *m)
+		if err != nil {
+			return fmt.Errorf("message append error of %q: %v", subject, err)
+		}
+	}
+
+	if err := deleteOldMessages(c, subject, date, body); err != nil {
+		return err
+	}
+	if appended {
+		return errUnchanged
+	}
+	return nil
+}
+
+// samePomiHeaders reports whether a and b have the same X-Pomi-* headers, even if encoded differently.
+func samePomiHeaders(a, b mail.Header) bool {
+	pomiHeaders := func(h mail.Header) map[string]string {
+		m := make(map[string]string)
+		for k, v := range h {
+			if k = textproto.CanonicalMIMEHeaderKey(k); strings.HasPrefix(k, "X-Pomi-") && len(v) > 0 {
+				m[k] = decodeHeader(v[0])
+			}
+		}
+		return m
+	}
+
+	ha, hb := pomiHeaders(a), pomiHeaders(b)
+	if len(ha) != len(hb) {
+		return false
+	}
+	for k, v := range ha {
+		if w, found := hb[k]; !found || v != w {
+			return false
+		}
 	}
+	return true
+}
+
+// expungeMu serializes expunges of workers on different connections,
+// so that a seq found by one worker is not shifted by another before it is used.
+var expungeMu sync.Mutex
+
+// deleteOldMessages deletes messages of subject except the newest one having date and body.
+func deleteOldMessages(c *imapConn, subject, date string, body []byte) error {
+	expungeMu.Lock()
+	defer expungeMu.Unlock()
 
-	m, err = imapclient.EncodeMailMessage(m)
+	found, err := findMessagesBySubject(c, subject)
 	if err != nil {
-		return fmt.Errorf("message encode error of %q: %v", subject, err)
+		return err
 	}
 
-	if len(seqs) > 0 {
-		err = c.Store(fmt.Sprintf("%v", seqs[0]), "+FLAGS", []string{imapclient.FlagDeleted})
-		if err != nil {
-			return fmt.Errorf("flag set error of %q: %v", subject, err)
+	keep := uint32(0)
+	for _, f := range found {
+		if sameDate(f.Msg.Header.Get("Date"), date) && bytes.Equal(f.Body, body) {
+			keep = f.Seq
 		}
-		err = c.Expunge()
-		if err != nil {
-			return fmt.Errorf("delete error of %q: %v", subject, err)
+	}
+
+	var seqs []uint32
+	for _, f := range found {
+		if f.Seq != keep {
+			seqs = append(seqs, f.Seq)
 		}
 	}
+	if len(seqs) == 0 {
+		return nil
+	}
 
-	err = c.Append(box, nil, *m)
+	logTrace("imap", "cmd", "STORE +FLAGS \\Deleted / EXPUNGE", "seqset", joinUint32(seqs, ","), "subject", subject)
+	err = c.Store(joinUint32(seqs, ","), "+FLAGS", []string{imapclient.FlagDeleted})
+	if err != nil {
+		return fmt.Errorf("flag set error of %q: %v", subject, err)
+	}
+	err = c.Expunge()
 	if err != nil {
-		return fmt.Errorf("message append error of %q: %v", subject, err)
+		return fmt.Errorf("delete error of %q: %v", subject, err)
 	}
 
 	return nil
 }
 
-func deleteMessage(ic *imapclient.Client, all bool, subject, seq string) error {
-	if all {
-		seq = "1:9999999"
-	} else if subject != "" {
-		seq = resolveSeqBySubject(ic, subject)
+// sameDate reports whether Date headers a and b are the same time, even if formatted differently.
+func sameDate(a, b string) bool {
+	if a == b {
+		return true
+	}
+	ta, erra := mail.ParseDate(a)
+	tb, errb := mail.ParseDate(b)
+	return erra == nil && errb == nil && ta.Equal(tb)
+}
+
+type foundMessage struct {
+	Seq  uint32
+	Msg  *mail.Message // the text part
+	Body []byte        // the decoded body of Msg
+}
+
+// findMessagesBySubject returns messages whose subject is exactly subject, in seq order.
+func findMessagesBySubject(c *imapConn, subject string) ([]foundMessage, error) {
+	logTrace("imap", "cmd", "SEARCH SUBJECT", "subject", subject)
+	seqs, err := c.Search("SUBJECT", subject)
+	if err != nil {
+		return nil, fmt.Errorf("failed to search %q: %v", subject, err)
+	}
+	if len(seqs) == 0 {
+		return nil, nil
+	}
+
+	msgmap, err := c.Fetch(joinUint32(seqs, ","))
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch %q: %v", subject, err)
+	}
+
+	var found []foundMessage
+	for seq, ref := range msgmap {
+		dref, err := imapclient.DecodeMailMessage(ref)
+		if err != nil {
+			continue
+		}
+		tref := pickupTextPartMessage(dref)
+		if tref == nil || tref.Header.Get("Subject") != subject {
+			continue
+		}
+
+		body, err := ioutil.ReadAll(tref.Body)
+		if err != nil {
+			return nil, fmt.Errorf("on subject[%v]: body reading error: %v", subject, err)
+		}
+		tref.Body = bytes.NewReader(body)
+
+		found = append(found, foundMessage{Seq: seq, Msg: tref, Body: body})
+	}
+	sort.Slice(found, func(i, j int) bool {
+		return found[i].Seq < found[j].Seq
+	})
+
+	return found, nil
+}
+
+// findMessageBySubject returns the seq and the text part of the newest message whose subject is exactly subject.
+// seq is 0 if no message matches.
+func findMessageBySubject(c *imapConn, subject string) (uint32, *mail.Message, error) {
+	found, err := findMessagesBySubject(c, subject)
+	if err != nil || len(found) == 0 {
+		return 0, nil, err
 	}
 
+	f := found[len(found)-1]
+	return f.Seq, f.Msg, nil
+}
+
+func deleteMessage(ic *imapConn, all bool, subject, seq string) error {
+	_, err := deleteMessageWithProgress(ic, all, subject, seq, nil)
+	return err
+}
+
+// deleteMessageWithProgress is deleteMessage reporting each message to p.
+// It returns the subjects deleted, including the memos whose parts are deleted, to be dropped from the search index.
+func deleteMessageWithProgress(ic *imapConn, all bool, subject, seq string, p *progress) ([]string, error) {
+	seq = resolveSeq(ic, all, subject, seq)
 	if seq == "" {
 		fmt.Fprintf(os.Stderr, "no matches\n")
-		return nil
+		return nil, nil
 	}
 
-	err := ic.Store(seq, "+FLAGS", []string{imapclient.FlagDeleted})
+	var names, subjects []string
+	mm, err := ic.Fetch(seq, true)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	seqs := make([]uint32, 0, len(mm))
+	for s := range mm {
+		seqs = append(seqs, s)
 	}
+	sortSeqs(seqs, false)
+	for _, s := range seqs {
+		name := fmt.Sprintf("#%d", s)
+		if hm, err := imapclient.DecodeMailMessage(mm[s], true); err == nil && len(hm) > 0 {
+			name = hm[0].Header.Get("Subject")
+			subjects = append(subjects, name)
+			if parent, _, _, ok := parsePart(hm[0]); ok {
+				subjects = append(subjects, parent)
+			}
+		}
+		names = append(names, name)
+	}
+	p.setTotal(len(names), 0)
+
+	logTrace("imap", "cmd", "STORE +FLAGS \\Deleted / EXPUNGE", "seqset", seq)
+	err = critical(func() error {
+		err := ic.Store(seq, "+FLAGS", []string{imapclient.FlagDeleted})
+		if err != nil {
+			return err
+		}
 
-	err = ic.Expunge()
+		return ic.Expunge()
+	})
+
+	// messages are deleted at once by EXPUNGE
+	for _, name := range names {
+		p.report(name, 0, err)
+	}
 	if err != nil {
-		return err
+		return nil, err
 	}
+	return uniqueStrings(subjects), nil
+}
 
-	return nil
+type putOptions struct {
+	// Jobs is the number of files put concurrently. (default: defaultPutJobs)
+	Jobs int
+	// Progress, if set, receives the result of each file.
+	Progress *progress
+	// Local is the format of local files. (default: UTF-8 or detected, as is)
+	Local localFormat
+	// Pomera, if set, validates memos before they are put.
+	Pomera *pomeraPolicy
+	// SplitChars, if positive, splits a memo longer than it into parts.
+	SplitChars int
+	// FrontMatter, if set, maps front matter at the top of a file to headers and strips it.
+	FrontMatter bool
+}
+
+const defaultPutJobs = 4
+
+// putErrors aggregates errors of files failed to put.
+type putErrors []error
+
+func (errs putErrors) Error() string {
+	ss := make([]string, len(errs))
+	for i, err := range errs {
+		ss[i] = err.Error()
+	}
+	return fmt.Sprintf("failed to put %d file(s):\n%v", len(errs), strings.Join(ss, "\n"))
 }
 
 func putMessages(config *config, syncDirPath string, patterns []string, stdinName string, disp func(string, error)) (count int, err error) {
+	return putMessagesWithOptions(rootCtx, config, syncDirPath, patterns, stdinName, putOptions{}, disp)
+}
+
+// putMessagesWithOptions puts files matched by patterns through a bounded pool of workers sharing IMAP connections.
+// The returned error is putErrors if some files fail.
+//
+// When ctx is done, the files being put are finished and the rest are left.
+func putMessagesWithOptions(ctx context.Context, config *config, syncDirPath string, patterns []string, stdinName string, opts putOptions, disp func(string, error)) (count int, err error) {
+	if stdinName != "" {
+		return putStdinMessage(config, stdinName, opts, disp)
+	}
+
+	var files []string
+	found := make(map[string]bool)
 	for _, pat := range patterns {
 		matches, err := filepath.Glob(filepath.Join(syncDirPath, pat))
 		if err != nil {
-			continue
+			return 0, fmt.Errorf("bad pattern %q: %v", pat, err)
 		}
-		if len(matches) == 0 {
-			return 0, nil
+		for _, fn := range matches {
+			if !found[fn] {
+				found[fn] = true
+				files = append(files, fn)
+			}
 		}
+	}
+	if len(files) == 0 {
+		return 0, nil
+	}
 
-		var mu sync.Mutex
-		errs := []error{}
-		var wg sync.WaitGroup
+	idx, ierr := openSearchIndex(indexPath(config))
+	if ierr != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", ierr)
+	}
 
-		for _, fn := range matches {
-			wg.Add(1)
-			go func(fn string) {
-				//log.Debug(fn)
+	jobs := opts.Jobs
+	if jobs <= 0 {
+		jobs = defaultPutJobs
+	}
+	if jobs > len(files) {
+		jobs = len(files)
+	}
+	pool := newIMAPPool(config, jobs)
+	defer pool.close()
+
+	if opts.Pomera != nil && opts.Pomera.MaxMemos > 0 {
+		if err := checkPutMemoCount(pool, *opts.Pomera, files); err != nil {
+			return 0, err
+		}
+	}
 
-				f, err := os.Open(fn)
+	var totalBytes int64
+	for _, fn := range files {
+		if info, err := os.Stat(fn); err == nil && !info.IsDir() {
+			totalBytes += info.Size()
+		}
+	}
+	opts.Progress.setTotal(len(files), totalBytes)
+
+	var mu sync.Mutex
+	var errs putErrors
+	report := func(fn string, size int, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if statusOf(err) == itemFailed {
+			errs = append(errs, fmt.Errorf("%v: %v", fn, err))
+			if disp != nil {
+				disp(fn, err)
+			}
+		}
+		opts.Progress.report(fn, int64(size), err)
+	}
+
+	fileChan := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < jobs; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for fn := range fileChan {
+				subject, ext, tm, data, err := readPutFile(fn)
+				if err == nil {
+					data, err = opts.Local.toRemote(fn, data)
+				}
+				var extra mail.Header
+				if err == nil && opts.FrontMatter {
+					subject, tm, data, extra = applyFrontMatter(fn, subject, tm, data)
+				}
+				var parts [][]byte
+				if err == nil {
+					parts, err = preparePutParts(opts, fn, subject, data)
+				}
 				if err != nil {
-					if disp != nil {
-						mu.Lock()
-						disp(fn, err)
-						mu.Unlock()
-					}
-					return
+					report(fn, 0, err)
+					continue
 				}
-
+				if len(parts) > 1 {
+					logInfo("split", "file", fn, "parts", len(parts))
+				}
+				data = bytes.Join(parts, nil)
 				if disp != nil {
-					mu.Lock()
 					disp(fn, nil)
-					mu.Unlock()
 				}
 
-				_, subject := filepath.Split(filepath.Base(fn))
-				ext := ""
-				extpos := strings.LastIndex(subject, ".")
-				if extpos != -1 {
-					ext = subject[extpos+1:]
-					subject = subject[:extpos]
-				}
+				// putMessage does not duplicate the message when it is called again
+				err = retry(ctx, config, fn, func() error {
+					ic, err := pool.get()
+					if err != nil {
+						return err
+					}
 
-				var tm time.Time
-				info, err := f.Stat()
-				if err == nil {
-					tm = info.ModTime()
+					// a timeout closes the connection, so nothing of this attempt runs on while retrying
+					logDebug("put", "file", fn, "subject", subject, "size", len(data))
+					if opts.SplitChars > 0 {
+						err = putParts(ic, config.IMAP.Box, config.IMAP.User, subject, ext, extra, opts.FrontMatter, parts, tm)
+					} else {
+						err = putMessageUnlessUnchanged(ic, config.IMAP.Box, config.IMAP.User, subject, ext, extra, opts.FrontMatter, bytes.NewReader(parts[0]), tm)
+					}
+					pool.release(ic, err != nil && err != errUnchanged)
+					return err
+				})
+				if statusOf(err) == itemFailed {
+					logError("put", "file", fn, "err", err)
+				} else {
+					logInfo("put", "file", fn, "status", itemStatusNames[statusOf(err)])
 				}
-
-				//log.Debug("putMessage", fn)
-				iic, _ := initIMAP(config)
-				err = putMessage(iic, config.IMAP.Box, config.IMAP.User, subject, ext, f, tm)
-				//log.Debug("end putMessage", fn)
-				if err != nil {
-					mu.Lock()
-					errs = append(errs, err)
-					mu.Unlock()
-					return
+				report(fn, len(data), err)
+				if statusOf(err) == itemFailed {
+					continue
 				}
+
 				mu.Lock()
 				count++
 				mu.Unlock()
 
-				iic.Logout()
-				f.Close()
+				if idx != nil {
+					idx.add(subject, ext, tm, data)
+				}
+			}
+		}()
+	}
 
-				wg.Done()
-			}(fn)
+	left := 0
+	for i, fn := range files {
+		if ctx.Err() != nil {
+			left = len(files) - i
+			break
 		}
-		wg.Wait()
+		fileChan <- fn
+	}
+	close(fileChan)
+	wg.Wait()
+
+	if left > 0 {
+		errs = append(errs, fmt.Errorf("%d file(s) left: %v", left, ctx.Err()))
 	}
 
+	if idx != nil {
+		if ierr := idx.save(); ierr != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", ierr)
+		}
+	}
+
+	if len(errs) > 0 {
+		return count, errs
+	}
 	return count, nil
 }
 
+// readPutFile reads a local file to be put as a message.
+func readPutFile(fn string) (subject, ext string, tm time.Time, data []byte, err error) {
+	subject, ext = splitSubjectExt(filepath.Base(fn))
+
+	info, err := os.Stat(fn)
+	if err != nil {
+		return "", "", tm, nil, err
+	}
+	if info.IsDir() {
+		return "", "", tm, nil, errSkipped{"is a directory"}
+	}
+	tm = info.ModTime()
+
+	data, err = ioutil.ReadFile(fn)
+	if err != nil {
+		return "", "", tm, nil, err
+	}
+
+	return subject, ext, tm, data, nil
+}
+
+// putStdinMessage puts stdin as a message named name (SUBJECT.EXT).
+func putStdinMessage(config *config, name string, opts putOptions, disp func(string, error)) (int, error) {
+	subject, ext := splitSubjectExt(name)
+
+	data, err := ioutil.ReadAll(os.Stdin)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read stdin: %v", err)
+	}
+	data, err = opts.Local.toRemote("stdin", data)
+	tm := time.Now()
+	var extra mail.Header
+	if err == nil && opts.FrontMatter {
+		subject, tm, data, extra = applyFrontMatter("stdin", subject, tm, data)
+	}
+	var parts [][]byte
+	if err == nil {
+		parts, err = preparePutParts(opts, "stdin", subject, data)
+	}
+	if err != nil {
+		return 0, err
+	}
+	data = bytes.Join(parts, nil)
+	if disp != nil {
+		disp(name, nil)
+	}
+
+	ic, err := initIMAP(config)
+	if err != nil {
+		return 0, err
+	}
+	defer ic.Logout()
+
+	if opts.SplitChars > 0 {
+		err = putParts(ic, config.IMAP.Box, config.IMAP.User, subject, ext, extra, opts.FrontMatter, parts, tm)
+	} else {
+		err = putMessageUnlessUnchanged(ic, config.IMAP.Box, config.IMAP.User, subject, ext, extra, opts.FrontMatter, bytes.NewReader(parts[0]), tm)
+	}
+	if err == errUnchanged {
+		err = nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	indexMessage(config, subject, ext, tm, data)
+
+	return 1, nil
+}
+
+// preparePutParts splits data of a memo by opts.SplitChars and validates each part.
+// Without splitting, the only part is data.
+func preparePutParts(opts putOptions, name, subject string, data []byte) ([][]byte, error) {
+	parts := [][]byte{data}
+	if opts.SplitChars > 0 {
+		parts = splitMemo(data, opts.SplitChars)
+	}
+
+	for i, part := range parts {
+		partName := subject
+		if len(parts) > 1 {
+			partName = partSubject(subject, i+1, len(parts))
+		}
+
+		var err error
+		parts[i], err = validatePutData(opts.Pomera, name, partName, part)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return parts, nil
+}
+
+// validatePutData checks data of a memo by p (if not nil) and warns problems allowed by the policy.
+func validatePutData(p *pomeraPolicy, name, subject string, data []byte) ([]byte, error) {
+	if p == nil {
+		return data, nil
+	}
+
+	data, err := p.check(subject, data)
+	if verr, ok := err.(validationError); ok {
+		logWarn("validation", "file", name, "err", verr)
+		fmt.Fprintf(os.Stderr, "%v: %v\n", name, verr)
+		return data, nil
+	}
+	return data, err
+}
+
+// checkPutMemoCount validates the number of memos after files are put.
+func checkPutMemoCount(pool *imapPool, p pomeraPolicy, files []string) error {
+	ic, err := pool.get()
+	if err != nil {
+		return err
+	}
+
+	existing := make(map[string]bool)
+	seqs, err := ic.Search("ALL")
+	if err == nil && len(seqs) > 0 {
+		var mm map[uint32]*mail.Message
+		mm, err = ic.Fetch(joinUint32(seqs, ","), true)
+		for _, m := range mm {
+			if hm, derr := imapclient.DecodeMailMessage(m, true); derr == nil && len(hm) > 0 {
+				existing[hm[0].Header.Get("Subject")] = true
+			}
+		}
+	}
+	pool.release(ic, err != nil)
+	if err != nil {
+		return fmt.Errorf("failed to count memos: %v", err)
+	}
+
+	newMemos := 0
+	for _, fn := range files {
+		subject, _ := splitSubjectExt(filepath.Base(fn))
+		if !existing[subject] {
+			existing[subject] = true
+			newMemos++
+		}
+	}
+
+	err = p.checkMemoCount(len(seqs), newMemos)
+	if err == nil {
+		return nil
+	}
+	if p.Policy == policyBlock {
+		return err
+	}
+	logWarn("validation", "err", err)
+	fmt.Fprintf(os.Stderr, "%v\n", err)
+	return nil
+}
+
+// splitSubjectExt splits a file name into a subject and an extension without a dot.
+func splitSubjectExt(name string) (subject, ext string) {
+	extpos := strings.LastIndex(name, ".")
+	if extpos == -1 {
+		return name, ""
+	}
+	return name[:extpos], name[extpos+1:]
+}
+
 type listElement struct {
-	Seq     uint32
-	Subject string
-	Date    string
+	Seq     uint32   `json:"seq"`
+	UID     uint32   `json:"uid"`
+	Subject string   `json:"subject"`
+	Date    string   `json:"date"`
+	Ext     string   `json:"ext"`
+	Size    int      `json:"size"`
+	Flags   []string `json:"flags"`
+	Tags    []string `json:"tags,omitempty"`
 }
 
-func listMessages(c *imapclient.Client, criteria, keyword string) ([]listElement, error) {
-	var seqs []uint32
-	var err error
+type listOptions struct {
+	// Size fetches whole messages to fill listElement.Size.
+	Size bool
+
+	// Sort is one of seq (default), date, subject and size.
+	Sort    string
+	Reverse bool
+	// Offset skips messages after sorting. Limit (> 0) caps the number of messages.
+	Offset int
+	Limit  int
+}
+
+// imapSortKeys maps listOptions.Sort to a key of SORT (RFC 5256), used if the server has the capability.
+// Otherwise, or by the other keys, messages are sorted after fetching all of them.
+// The server compares subjects without "Re:" and the like, and sizes of whole messages.
+var imapSortKeys = map[string]string{
+	"date":    "DATE",
+	"subject": "SUBJECT",
+	"size":    "SIZE",
+}
+
+// listedFlags are system flags reported in listElement.Flags.
+var listedFlags = []string{`\Seen`, `\Answered`, `\Flagged`, `\Draft`}
+
+// listMessages lists messages matched by keyword, a query whose words without keys are searched by criteria.
+func listMessages(c *imapConn, criteria, keyword string) ([]listElement, error) {
+	return listMessagesWithOptions(c, criteria, keyword, listOptions{})
+}
 
-	if strings.Trim(keyword, " ") == "" {
-		seqs, err = c.Search("ALL")
+func listMessagesWithOptions(c *imapConn, criteria, keyword string, opts listOptions) ([]listElement, error) {
+	q, err := parseQuery(keyword, criteria)
+	if err != nil {
+		return nil, err
+	}
+
+	// sorted is whether seqs are in the order to list, so that only the page is fetched
+	var seqs []uint32
+	var sorted bool
+	if key, found := imapSortKeys[opts.Sort]; found && c.has("SORT") {
+		if opts.Reverse {
+			key = "REVERSE " + key
+		}
+		logTrace("imap", "cmd", "SORT", "keys", key)
+		seqs, err = c.Sort(key, q.searchKeys())
+		sorted = true
 	} else {
-		seqs, err = c.Search(criteria, keyword)
+		seqs, err = q.search(c)
+		if opts.Sort == "" || opts.Sort == "seq" {
+			sortSeqs(seqs, opts.Reverse)
+			sorted = true
+		}
 	}
 	if err != nil {
 		return nil, fmt.Errorf("failed to list messages: %v\n", err)
 	}
+
+	if sorted {
+		start, end := pageRange(len(seqs), opts.Offset, opts.Limit)
+		seqs = seqs[start:end]
+	}
 	if len(seqs) == 0 {
 		return nil, nil
 	}
+	order := make(map[uint32]int, len(seqs))
+	for i, seq := range seqs {
+		order[seq] = i
+	}
 
-	//log.Printf("seqs=%#v\n", seqs)
 	seqset := joinUint32(seqs, ",")
-	//log.Printf("seqset=%v\n", seqset)
-	msgs, err := c.Fetch(seqset, true)
+	logTrace("imap", "cmd", "FETCH", "seqset", seqset, "header", !opts.Size)
+	fetched, err := c.fetch(false, seqset, !opts.Size)
 	if err != nil {
 		return nil, fmt.Errorf("failed to fetch messages: %v\n", err)
 	}
-
-	// convert random []seq in map[seq]msg to sorted []seqs
-	seqs = make([]uint32, 0, len(msgs))
-	for seq, _ := range msgs {
-		seqs = append(seqs, seq)
-	}
-	sort.Slice(seqs, func(i, j int) bool {
-		return seqs[i] < seqs[j]
+	sort.Slice(fetched, func(i, j int) bool {
+		return order[fetched[i].Seq] < order[fetched[j].Seq]
 	})
 
-	list := make([]listElement, 0, len(msgs))
-	for _, seq := range seqs {
-		msg := msgs[seq]
-		textMsg, err := decodeMessageAsTextMessage(msg, true)
+	list := make([]listElement, 0, len(fetched))
+	for _, f := range fetched {
+		seq := f.Seq
+		msg, err := mail.ReadMessage(bytes.NewReader(f.Data))
+		if err != nil {
+			return nil, fmt.Errorf("broken message #%d: %v", seq, err)
+		}
+		textMsg, err := decodeMessageAsTextMessage(msg, !opts.Size)
 		if err != nil {
 			return nil, err
 		}
 
+		size := 0
+		if opts.Size {
+			body, err := ioutil.ReadAll(textMsg.Body)
+			if err != nil {
+				return nil, fmt.Errorf("on subject[%v]: body reading error: %v", textMsg.Header.Get("Subject"), err)
+			}
+			size = len(bytes.TrimPrefix(body, utf8BOM))
+		}
+
+		var flags []string
+		for _, flag := range listedFlags {
+			if containsString(f.Flags, flag) {
+				flags = append(flags, flag)
+			}
+		}
+
 		list = append(list, listElement{
 			Seq:     seq,
+			UID:     f.UID,
 			Subject: textMsg.Header.Get("Subject"),
 			Date:    textMsg.Header.Get("Date"),
+			Ext:     textMsg.Header.Get("X-Pomi-Ext"),
+			Size:    size,
+			Flags:   flags,
+			Tags:    mergeTags(flagTags(f.Flags), parseTagsHeader(textMsg.Header.Get(tagsHeader)), nil),
 		})
 	}
 
+	if !sorted {
+		if err := sortList(list, opts.Sort, opts.Reverse); err != nil {
+			return nil, err
+		}
+		start, end := pageRange(len(list), opts.Offset, opts.Limit)
+		list = list[start:end]
+	}
+
 	return list, nil
 }
 
-func getMessages(ic *imapclient.Client, header, all bool, subject, seq string, syncDirPath, ext string, msgWriter MsgWriter) error {
-	if all {
-		seq = "1:9999999"
-	} else if subject != "" {
-		seq = resolveSeqBySubject(ic, subject)
+func sortSeqs(seqs []uint32, reverse bool) {
+	sort.Slice(seqs, func(i, j int) bool {
+		if reverse {
+			return seqs[i] > seqs[j]
+		}
+		return seqs[i] < seqs[j]
+	})
+}
+
+// pageRange returns the start and end index of a page in n elements.
+func pageRange(n, offset, limit int) (start, end int) {
+	start = offset
+	if start < 0 {
+		start = 0
+	}
+	if start > n {
+		start = n
+	}
+	end = n
+	if limit > 0 && start+limit < n {
+		end = start + limit
+	}
+	return start, end
+}
+
+// sortList sorts list stably by key (seq, date, subject or size).
+// Messages with a broken Date come first on date.
+func sortList(list []listElement, key string, reverse bool) error {
+	var less func(a, b *listElement) bool
+
+	switch key {
+	case "", "seq":
+		less = func(a, b *listElement) bool { return a.Seq < b.Seq }
+	case "subject":
+		less = func(a, b *listElement) bool { return a.Subject < b.Subject }
+	case "size":
+		less = func(a, b *listElement) bool { return a.Size < b.Size }
+	case "date":
+		dates := make(map[uint32]time.Time, len(list))
+		for _, e := range list {
+			if tm, err := mail.ParseDate(e.Date); err == nil {
+				dates[e.Seq] = tm
+			}
+		}
+		less = func(a, b *listElement) bool { return dates[a.Seq].Before(dates[b.Seq]) }
+	default:
+		return fmt.Errorf("unknown sort key %q", key)
+	}
+
+	sort.SliceStable(list, func(i, j int) bool {
+		if reverse {
+			return less(&list[j], &list[i])
+		}
+		return less(&list[i], &list[j])
+	})
+	return nil
+}
+
+// fetchFlags returns listedFlags set on each message in seqset.
+func fetchFlags(c *imapConn, seqset string) (map[uint32][]string, error) {
+	fetched, err := c.fetchItems(false, seqset, "FLAGS")
+	if err != nil {
+		return nil, err
 	}
 
+	flags := make(map[uint32][]string)
+	for _, f := range fetched {
+		for _, flag := range listedFlags {
+			if containsString(f.Flags, flag) {
+				flags[f.Seq] = append(flags[f.Seq], flag)
+			}
+		}
+	}
+	return flags, nil
+}
+
+type getOptions struct {
+	// BatchSize is the number of messages fetched at once. (default: defaultGetBatchSize)
+	BatchSize int
+	// Jobs is the number of messages decoded and written concurrently. (default: 1)
+	// msgWriter must be safe for concurrent use if Jobs > 1.
+	Jobs int
+	// Progress, if set, receives the result of each message.
+	Progress *progress
+	// Reconnect, if set, is called to retry a failed fetch with a new connection, following Retry.
+	Reconnect func() (*imapConn, error)
+	Retry     retryPolicy
+	// Join, if set, writes parts of a memo split by put as one file.
+	Join bool
+	// Body is the body of a message having both text/plain and text/html. (default: bodyPlain)
+	Body string
+	// Attachments, if set, is the directory to save non-text parts in.
+	Attachments string
+	// RawHTML, if set, writes HTML bodies as they are instead of converting them into text.
+	RawHTML bool
+	// FrontMatter, if set, regenerates front matter of a memo put with it.
+	FrontMatter bool
+}
+
+const defaultGetBatchSize = 100
+
+func getMessages(ic *imapConn, header, all bool, subject, seq string, syncDirPath, ext string, msgWriter MsgWriter) error {
+	return getMessagesWithOptions(rootCtx, ic, header, all, subject, seq, syncDirPath, ext, getOptions{}, msgWriter)
+}
+
+// getMessagesWithOptions fetches messages in batches and passes them to a bounded pool of writers.
+// Each batch is fetched while the previous one is being written.
+//
+// When ctx is done, the fetched batch is written and the rest are left.
+func getMessagesWithOptions(ctx context.Context, ic *imapConn, header, all bool, subject, seq string, syncDirPath, ext string, opts getOptions, msgWriter MsgWriter) error {
+	seq = resolveSeq(ic, all, subject, seq)
 	if seq == "" {
 		fmt.Fprintf(os.Stderr, "no matches\n")
 		return nil
 	}
 
-	mm, err := ic.Fetch(seq)
+	// UIDs are a snapshot of the messages to get, not shifted by an expunge during the run
+	var uids []uint32
+	var err error
+	if all {
+		uids, err = ic.UIDSearch("ALL")
+	} else {
+		// a sequence set is a search key
+		uids, err = ic.UIDSearch(seq)
+	}
 	if err != nil {
 		return err
 	}
+	if len(uids) == 0 {
+		fmt.Fprintf(os.Stderr, "no matches\n")
+		return nil
+	}
+	sortSeqs(uids, false)
 
 	// arrange workdir
 	if syncDirPath != "." {
-		if err := os.MkdirAll(syncDirPath, os.ModeDir); err != nil {
+		if err := os.MkdirAll(syncDirPath, os.ModeDir|0755); err != nil {
 			return err
 		}
 	}
 
-	for _, m := range mm {
-		textMsg, err := decodeMessageAsTextMessage(m, false)
-		if err != nil {
-			return err
+	batchSize := opts.BatchSize
+	if batchSize <= 0 {
+		batchSize = defaultGetBatchSize
+	}
+	jobs := opts.Jobs
+	if jobs <= 0 {
+		jobs = 1
+	}
+
+	opts.Progress.setTotal(len(uids), 0)
+
+	var mu sync.Mutex
+	var errs []error
+	write := func(name string, textMsg *mail.Message, err error) {
+		var size int64
+		if err == nil && opts.FrontMatter {
+			err = withFrontMatter(textMsg)
+		}
+		if err == nil {
+			name = textMsg.Header.Get("Subject")
+			textMsg.Body = &countingReader{r: textMsg.Body, n: &size}
+			err = writeMessage(textMsg, header, syncDirPath, ext, msgWriter)
 		}
 
-		if err := writeMessage(textMsg, header, syncDirPath, ext, msgWriter); err != nil {
-			return err
+		mu.Lock()
+		if statusOf(err) == itemFailed {
+			errs = append(errs, err)
+		}
+		mu.Unlock()
+		if statusOf(err) == itemFailed {
+			logError("get", "subject", name, "err", err)
+		} else {
+			logDebug("get", "subject", name, "size", size, "status", itemStatusNames[statusOf(err)])
 		}
+		opts.Progress.report(name, size, err)
 	}
 
-	return nil
-}
+	var asm *partAssembler
+	if opts.Join {
+		asm = newPartAssembler()
+	}
 
-func decodeMessageAsTextMessage(msg *mail.Message, header bool) (*mail.Message, error) {
-	decodedMsg, err := imapclient.DecodeMailMessage(msg, header)
-	if err != nil {
-		// try to refer headers
-		headerMsg, herr := imapclient.DecodeMailMessage(msg, true)
-		if herr != nil {
-			return nil, herr
+	msgChan := make(chan *mail.Message, batchSize)
+	var wg sync.WaitGroup
+	for i := 0; i < jobs; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for m := range msgChan {
+				name := m.Header.Get("Subject")
+				var textMsg *mail.Message
+				dm, err := decodeMessage(m, false, opts.Body, opts.RawHTML)
+				if err == nil {
+					textMsg = dm.Text
+					err = reportParts(dm, opts.Attachments)
+				}
+				if err == nil && asm != nil {
+					if parent, i, n, ok := parsePart(textMsg); ok {
+						var joined *mail.Message
+						joined, err = asm.add(parent, i, n, textMsg)
+						if err == nil && joined == nil {
+							// written with the last part
+							continue
+						}
+						textMsg = joined
+						name = parent
+						opts.Progress.merge(n)
+					}
+				}
+				write(name, textMsg, err)
+			}
+		}()
+	}
+
+	// Batches are of UIDs, which stay valid over reconnections and expunges.
+	var reconnected []*imapConn
+	defer func() {
+		for _, c := range reconnected {
+			c.Logout()
+		}
+	}()
+
+	var fetchErr error
+	for start := 0; start < len(uids); start += batchSize {
+		end := start + batchSize
+		if end > len(uids) {
+			end = len(uids)
+		}
+		batch := uids[start:end]
+
+		if ctx.Err() != nil {
+			fetchErr = fmt.Errorf("%d message(s) left: %v", len(uids)-start, ctx.Err())
+			break
+		}
+
+		var fetched []imapFetched
+		err := opts.Retry.do(ctx, "fetch", func() error {
+			if ic == nil {
+				c, err := opts.Reconnect()
+				if err != nil {
+					return err
+				}
+				ic = c
+				reconnected = append(reconnected, c)
+			}
+
+			logTrace("imap", "cmd", "UID FETCH", "uidset", joinUint32(batch, ","))
+			var err error
+			fetched, err = ic.fetch(true, joinUint32(batch, ","))
+			if err != nil && opts.Reconnect != nil {
+				ic = nil // the state of the connection is unknown
+			}
+			return err
+		})
+		if err != nil {
+			fetchErr = err
+			break
+		}
+		if len(fetched) < len(batch) {
+			logWarn("messages gone", "uidset", joinUint32(batch, ","), "fetched", len(fetched))
+			fmt.Fprintf(os.Stderr, "%d message(s) not fetched, expunged during the run\n", len(batch)-len(fetched))
+		}
+		sort.Slice(fetched, func(i, j int) bool {
+			return fetched[i].UID < fetched[j].UID
+		})
+		for _, f := range fetched {
+			m, err := mail.ReadMessage(bytes.NewReader(f.Data))
+			if err != nil {
+				write(fmt.Sprintf("#%d", f.Seq), nil, fmt.Errorf("broken message #%d: %v", f.Seq, err))
+				continue
+			}
+			// keywords are not in the message, but tags in its front matter
+			if kws := flagTags(f.Flags); opts.FrontMatter && len(kws) > 0 {
+				tags := mergeTags(parseTagsHeader(m.Header.Get(tagsHeader)), kws, nil)
+				m.Header[tagsHeader] = []string{formatTagsHeader(tags)}
+			}
+			msgChan <- m
 		}
-		decodedHeaderMsg := pickupTextPartMessage(headerMsg)
-		return nil, fmt.Errorf("on subject[%v]: %v", decodedHeaderMsg.Header.Get("Subject"), err)
 	}
-	if len(decodedMsg) == 0 {
-		return nil, fmt.Errorf("no decodable messages found on subject[%v]", msg.Header.Get("Subject"))
+	close(msgChan)
+	wg.Wait()
+
+	if asm != nil {
+		// the other parts are not in the box or not selected
+		for _, part := range asm.rest() {
+			name := part.Header.Get("Subject")
+			logWarn("incomplete memo", "subject", name)
+			fmt.Fprintf(os.Stderr, "%v: some parts are missing, written as is\n", name)
+			write(name, part, nil)
+		}
 	}
 
-	textMsg := pickupTextPartMessage(decodedMsg)
-	if textMsg == nil {
-		return nil, fmt.Errorf("no text part found on subject[%v]", decodedMsg[0].Header.Get("Subject"))
+	if fetchErr != nil {
+		return fetchErr
 	}
+	if len(errs) > 0 {
+		for _, err := range errs[1:] {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+		}
+		return errs[0]
+	}
+
+	return nil
+}
 
-	return textMsg, nil
+func decodeMessageAsTextMessage(msg *mail.Message, header bool) (*mail.Message, error) {
+	dm, err := decodeMessage(msg, header, bodyPlain, false)
+	if err != nil {
+		return nil, err
+	}
+	return dm.Text, nil
 }
 
 func writeMessage(msg *mail.Message, header bool, syncDirPath, ext string, msgWriter MsgWriter) error {
@@ -544,12 +1493,6 @@ func writeMessage(msg *mail.Message, header bool, syncDirPath, ext string, msgWr
 		buff.Write([]byte{'\r', '\n'})
 	}
 
-	body, err := ioutil.ReadAll(msg.Body)
-	if err != nil {
-		return fmt.Errorf("on subject[%v]: body reading error: %v", msg.Header.Get("Subject"), err)
-	}
-	buff.Write(body)
-
 	tm, err := msg.Header.Date()
 	if err != nil {
 		return err
@@ -560,7 +1503,8 @@ func writeMessage(msg *mail.Message, header bool, syncDirPath, ext string, msgWr
 		ext = pomiExt
 	}
 
-	err = msgWriter(syncDirPath, msg.Header.Get("Subject"), ext, tm, buff)
+	// stream the body
+	err = msgWriter(syncDirPath, msg.Header.Get("Subject"), ext, tm, io.MultiReader(buff, msg.Body))
 	return err
 }
 
@@ -572,7 +1516,17 @@ func getOutputWriteCloser(dir, subject, ext string) (*os.File, error) {
 	return file, nil
 }
 
-func resolveSeqBySubject(c *imapclient.Client, subject string) string {
+// resolveSeq returns a sequence set of all messages, messages matched by subject, or seq as is.
+func resolveSeq(c *imapConn, all bool, subject, seq string) string {
+	if all {
+		return "1:9999999"
+	} else if subject != "" {
+		return resolveSeqBySubject(c, subject)
+	}
+	return seq
+}
+
+func resolveSeqBySubject(c *imapConn, subject string) string {
 	seq, err := c.Search("SUBJECT", subject)
 	if err != nil || len(seq) == 0 {
 		return ""
@@ -585,18 +1539,39 @@ func resolveSeqBySubject(c *imapclient.Client, subject string) string {
 	return strings.Join(seqstrs, ",")
 }
 
-func refreshAccessToken(config *config) (string, error) {
+// getAccessToken returns an access token, refreshing it at most once per run.
+func (config *config) getAccessToken(ctx context.Context) (string, error) {
+	config.tokenMu.Lock()
+	defer config.tokenMu.Unlock()
+
+	if config.accessToken != "" {
+		return config.accessToken, nil
+	}
+
+	accessToken, err := refreshAccessToken(ctx, config)
+	if err != nil {
+		return "", err
+	}
+	addLogSecret(accessToken)
+	config.accessToken = accessToken
+
+	return accessToken, nil
+}
+
+func refreshAccessToken(ctx context.Context, config *config) (string, error) {
 	tokenURL := oauth2TokenBaseURL
 	form := url.Values{}
 	form.Add("client_id", apiClientID)
 	form.Add("client_secret", apiClientSecret)
 	form.Add("refresh_token", config.AUTH.RefreshToken)
 	form.Add("grant_type", "refresh_token")
-	resp, err := http.PostForm(tokenURL, form)
+	logTrace("http", "method", "POST", "url", tokenURL, "form", form.Encode())
+	resp, err := postForm(ctx, config.httpClient(), tokenURL, form)
 	if err != nil {
 		return "", err
 	}
 	defer resp.Body.Close()
+	logTrace("http", "url", tokenURL, "status", resp.Status)
 
 	dec := json.NewDecoder(resp.Body)
 	t := oAuth2AuthedTokens{}
@@ -662,8 +1637,15 @@ func pickupTextPartMessage(msgs []*mail.Message) *mail.Message {
 		return msgs[0]
 	}
 
-	for _, m := range msgs {
-		if strings.Contains(m.Header.Get("Content-Type"), "text") {
+	p := sortParts(msgs)
+	if p.Plain != nil {
+		return p.Plain
+	}
+	if p.HTML != nil {
+		return p.HTML
+	}
+	for _, m := range p.Others {
+		if strings.HasPrefix(mediaTypeOf(m), "text/") {
 			return m
 		}
 	}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// errUnchanged is returned by a MsgWriter when the output already has the very content.
+var errUnchanged = errors.New("unchanged")
+
+// errSkipped wraps a reason why an item is not processed at all.
+type errSkipped struct {
+	reason string
+}
+
+func (e errSkipped) Error() string {
+	return e.reason
+}
+
+type itemStatus int
+
+const (
+	itemSucceeded itemStatus = iota
+	itemUnchanged
+	itemSkipped
+	itemFailed
+)
+
+var itemStatusNames = []string{"succeeded", "unchanged", "skipped", "failed"}
+
+func statusOf(err error) itemStatus {
+	switch err.(type) {
+	case nil:
+		return itemSucceeded
+	case errSkipped:
+		return itemSkipped
+	}
+	if err == errUnchanged {
+		return itemUnchanged
+	}
+	return itemFailed
+}
+
+type progressItem struct {
+	Name   string
+	Status itemStatus
+	Err    error
+}
+
+// progress shows how a bulk operation goes and summarizes it at the end.
+// On a terminal, it redraws a bar in place; otherwise it prints a line per item.
+//
+// A nil *progress does nothing.
+type progress struct {
+	w    io.Writer
+	tty  bool
+	verb string
+
+	mu         sync.Mutex
+	total      int
+	totalBytes int64
+	done       int
+	bytes      int64
+	start      time.Time
+	items      []progressItem
+
+	now func() time.Time // for tests
+}
+
+func newProgress(w *os.File, verb string) *progress {
+	return &progress{
+		w:     w,
+		tty:   isTerminal(w),
+		verb:  verb,
+		start: time.Now(),
+		now:   time.Now,
+	}
+}
+
+// setTotal sets the number of items and their total bytes (0 if unknown) to estimate the time left.
+func (p *progress) setTotal(n int, bytes int64) {
+	if p == nil {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.total = n
+	p.totalBytes = bytes
+	p.start = p.now()
+}
+
+// merge counts n items as one, e.g. parts of a memo joined into a file.
+func (p *progress) merge(n int) {
+	if p == nil || n <= 1 {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.total -= n - 1
+}
+
+// report records the result of an item of size bytes.
+func (p *progress) report(name string, size int64, err error) {
+	if p == nil {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	st := statusOf(err)
+	p.items = append(p.items, progressItem{Name: name, Status: st, Err: err})
+	p.done++
+	p.bytes += size
+
+	if p.tty {
+		if st == itemFailed {
+			fmt.Fprintf(p.w, "\r\x1b[K%v: %v\n", name, err)
+		}
+		fmt.Fprintf(p.w, "\r\x1b[K%v", p.line())
+		return
+	}
+
+	switch st {
+	case itemFailed:
+		fmt.Fprintf(p.w, "[%d/%d] failed %v: %v\n", p.done, p.total, name, err)
+	case itemSucceeded:
+		fmt.Fprintf(p.w, "[%d/%d] %v %v (%v)\n", p.done, p.total, p.verb, name, formatBytes(size))
+	default:
+		fmt.Fprintf(p.w, "[%d/%d] %v %v\n", p.done, p.total, itemStatusNames[st], name)
+	}
+}
+
+// line renders the progress bar. p.mu must be locked.
+func (p *progress) line() string {
+	const width = 20
+
+	filled := 0
+	if p.total > 0 {
+		filled = width * p.done / p.total
+	}
+	if filled > width {
+		filled = width
+	}
+
+	s := fmt.Sprintf("%v [%v%v] %d/%d %v", p.verb, strings.Repeat("#", filled), strings.Repeat(".", width-filled), p.done, p.total, formatBytes(p.bytes))
+	if eta, ok := p.eta(); ok {
+		s += fmt.Sprintf(" ETA %v", eta)
+	}
+	return s
+}
+
+// eta estimates the time left by bytes if the total is known, otherwise by items.
+func (p *progress) eta() (time.Duration, bool) {
+	elapsed := p.now().Sub(p.start)
+
+	var ratio float64
+	switch {
+	case p.totalBytes > 0 && p.bytes > 0:
+		ratio = float64(p.bytes) / float64(p.totalBytes)
+	case p.total > 0 && p.done > 0:
+		ratio = float64(p.done) / float64(p.total)
+	default:
+		return 0, false
+	}
+	if ratio >= 1 {
+		return 0, false
+	}
+
+	left := time.Duration(float64(elapsed) * (1 - ratio) / ratio)
+	return left.Round(time.Second), true
+}
+
+// empty reports whether no item has been reported.
+func (p *progress) empty() bool {
+	if p == nil {
+		return true
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return len(p.items) == 0
+}
+
+// finish ends the bar and prints the summary table.
+func (p *progress) finish() {
+	if p == nil {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.tty && p.done > 0 {
+		fmt.Fprintln(p.w)
+	}
+	writeSummary(p.w, p.items, p.bytes, p.now().Sub(p.start))
+}
+
+// writeSummary writes counts by status, and the reasons of skipped and failed items.
+func writeSummary(w io.Writer, items []progressItem, bytes int64, elapsed time.Duration) {
+	if len(items) == 0 {
+		return
+	}
+
+	counts := make([]int, len(itemStatusNames))
+	for _, it := range items {
+		counts[it.Status]++
+	}
+
+	fmt.Fprintf(w, "%-10v %5v\n", "total", len(items))
+	for st, name := range itemStatusNames {
+		fmt.Fprintf(w, "%-10v %5v\n", name, counts[st])
+	}
+	fmt.Fprintf(w, "%v in %v\n", formatBytes(bytes), elapsed.Round(time.Millisecond))
+
+	for _, it := range items {
+		if it.Status == itemSkipped || it.Status == itemFailed {
+			fmt.Fprintf(w, "  %-9v %v: %v\n", itemStatusNames[it.Status], it.Name, it.Err)
+		}
+	}
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// countingReader adds the number of bytes read to *n.
+type countingReader struct {
+	r io.Reader
+	n *int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	*r.n += int64(n)
+	return n, err
+}
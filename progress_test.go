@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestProgress(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	buff := new(bytes.Buffer)
+	p := &progress{w: buff, verb: "put", now: func() time.Time { return now }}
+
+	p.setTotal(4, 4000)
+	now = now.Add(10 * time.Second)
+	p.report("a.txt", 1000, nil)
+	p.report("b.txt", 1000, errUnchanged)
+	p.report("dir", 0, errSkipped{"is a directory"})
+	p.report("c.txt", 0, errors.New("connection reset"))
+
+	if eta, ok := p.eta(); !ok || eta != 10*time.Second {
+		t.Errorf("eta: got %v, %v", eta, ok)
+	}
+
+	p.finish()
+
+	want := `[1/4] put a.txt (1000 B)
+[2/4] unchanged b.txt
+[3/4] skipped dir
+[4/4] failed c.txt: connection reset
+total          4
+succeeded      1
+unchanged      1
+skipped        1
+failed         1
+2.0 KiB in 10s
+  skipped   dir: is a directory
+  failed    c.txt: connection reset
+`
+	if got := buff.String(); got != want {
+		t.Errorf("got:\n%v\nwant:\n%v", got, want)
+	}
+}
+
+func TestProgressNil(t *testing.T) {
+	var p *progress
+	p.setTotal(1, 0)
+	p.report("a", 0, nil)
+	p.finish()
+	if !p.empty() {
+		t.Error("nil progress should be empty")
+	}
+}
+
+func TestFormatBytes(t *testing.T) {
+	for n, want := range map[int64]string{
+		0:           "0 B",
+		1023:        "1023 B",
+		1536:        "1.5 KiB",
+		3 << 20:     "3.0 MiB",
+		5 << 30 / 2: "2.5 GiB",
+	} {
+		if got := formatBytes(n); got != want {
+			t.Errorf("formatBytes(%v) = %q, want %q", n, got, want)
+		}
+	}
+}
@@ -0,0 +1,425 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// query is a parsed search expression of pomi list/get/show/delete.
+//
+//	subject:会議 since:2024-01-01 before:2024-06-01 body:TODO larger:2k not subject:draft
+//	(subject:a or subject:b) -body:done
+//	tag:work is:pinned is:unread
+//
+// Terms next to each other are ANDed. "or" binds weaker than AND, "not" or "-" negates a term or a group.
+// Words without a known key next to each other are a phrase searched by the default key,
+// so "pomi list foo bar" searches "foo bar" as ever.
+//
+// The whole query is compiled into a single SEARCH.
+type query struct {
+	op       queryOp
+	key      string // IMAP search key (on queryTerm)
+	value    string // IMAP search value (on queryTerm)
+	word     bool   // a word without a key (on queryTerm)
+	children []*query
+}
+
+type queryOp int
+
+const (
+	queryTerm queryOp = iota
+	queryAnd
+	queryOr
+	queryNot
+)
+
+// queryKeys maps a query key to a converter into an IMAP search key and value.
+// An empty value means the IMAP key takes no argument.
+var queryKeys = map[string]func(v string) (key, value string, err error){
+	"subject": imapStringKey("SUBJECT"),
+	"body":    imapStringKey("BODY"),
+	"text":    imapStringKey("TEXT"),
+	"from":    imapStringKey("FROM"),
+	"to":      imapStringKey("TO"),
+	// tags are keywords, or in X-Pomi-Tags
+	"tag": imapStringKey("KEYWORD"),
+	"is":  imapStateKey,
+	// memos are dated by the Date header (the timestamp of the file put), not by the arrival.
+	"since":   imapDateKey("SENTSINCE"),
+	"before":  imapDateKey("SENTBEFORE"),
+	"on":      imapDateKey("SENTON"),
+	"larger":  imapSizeKey("LARGER"),
+	"smaller": imapSizeKey("SMALLER"),
+}
+
+func imapStringKey(key string) func(string) (string, string, error) {
+	return func(v string) (string, string, error) {
+		if v == "" {
+			return "", "", fmt.Errorf("empty value for %v", strings.ToLower(key))
+		}
+		return key, v, nil
+	}
+}
+
+// imapStateKeys maps a state of is: to an IMAP search key on a flag.
+var imapStateKeys = map[string]string{
+	"pinned":   "FLAGGED",
+	"flagged":  "FLAGGED",
+	"unpinned": "UNFLAGGED",
+	"read":     "SEEN",
+	"seen":     "SEEN",
+	"unread":   "UNSEEN",
+	"unseen":   "UNSEEN",
+	"answered": "ANSWERED",
+	"draft":    "DRAFT",
+}
+
+func imapStateKey(v string) (string, string, error) {
+	key, found := imapStateKeys[strings.ToLower(v)]
+	if !found {
+		return "", "", fmt.Errorf("unknown state %q (pinned, unpinned, read, unread, answered, draft)", v)
+	}
+	return key, "", nil
+}
+
+func imapDateKey(key string) func(string) (string, string, error) {
+	return func(v string) (string, string, error) {
+		for _, layout := range []string{"2006-01-02", "2006/01/02", "20060102"} {
+			if tm, err := time.Parse(layout, v); err == nil {
+				return key, tm.Format("2-Jan-2006"), nil
+			}
+		}
+		return "", "", fmt.Errorf("invalid date %q (use YYYY-MM-DD)", v)
+	}
+}
+
+func imapSizeKey(key string) func(string) (string, string, error) {
+	return func(v string) (string, string, error) {
+		size, err := parseSize(v)
+		if err != nil {
+			return "", "", err
+		}
+		return key, strconv.FormatInt(size, 10), nil
+	}
+}
+
+// parseSize parses a byte size with an optional suffix k, m or g.
+func parseSize(s string) (int64, error) {
+	lower := strings.TrimSuffix(strings.ToLower(s), "b")
+	mul := int64(1)
+	switch {
+	case strings.HasSuffix(lower, "k"):
+		mul = 1024
+	case strings.HasSuffix(lower, "m"):
+		mul = 1024 * 1024
+	case strings.HasSuffix(lower, "g"):
+		mul = 1024 * 1024 * 1024
+	}
+	if mul != 1 {
+		lower = lower[:len(lower)-1]
+	}
+
+	n, err := strconv.ParseInt(lower, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return n * mul, nil
+}
+
+// parseQuery parses src. Words without a key are searched by defaultKey (an IMAP search key like SUBJECT).
+// An empty src results in nil, which matches all messages.
+func parseQuery(src, defaultKey string) (*query, error) {
+	tokens, err := splitQuery(src)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, nil
+	}
+	if defaultKey == "" {
+		defaultKey = "SUBJECT"
+	}
+
+	p := &queryParser{tokens: tokens, defaultKey: strings.ToUpper(defaultKey)}
+	q, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("unexpected %q in query", p.tokens[p.pos].text)
+	}
+	return q, nil
+}
+
+type queryToken struct {
+	text   string
+	quoted bool
+}
+
+// splitQuery splits src into words, parentheses and double-quoted phrases.
+func splitQuery(src string) ([]queryToken, error) {
+	var tokens []queryToken
+
+	rs := []rune(src)
+	for i := 0; i < len(rs); {
+		r := rs[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+
+		case r == '(' || r == ')':
+			tokens = append(tokens, queryToken{text: string(r)})
+			i++
+
+		default:
+			word := []rune{}
+			quoted := false
+			for i < len(rs) && !unicode.IsSpace(rs[i]) && rs[i] != '(' && rs[i] != ')' {
+				if rs[i] != '"' {
+					word = append(word, rs[i])
+					i++
+					continue
+				}
+
+				// key:"quoted value" or "quoted value"
+				quoted = true
+				end := i + 1
+				for end < len(rs) && rs[end] != '"' {
+					end++
+				}
+				if end >= len(rs) {
+					return nil, fmt.Errorf("unterminated quote in query")
+				}
+				word = append(word, rs[i+1:end]...)
+				i = end + 1
+			}
+			tokens = append(tokens, queryToken{text: string(word), quoted: quoted})
+		}
+	}
+
+	return tokens, nil
+}
+
+type queryParser struct {
+	tokens     []queryToken
+	pos        int
+	defaultKey string
+}
+
+func (p *queryParser) peekOperator(op string) bool {
+	return p.pos < len(p.tokens) && !p.tokens[p.pos].quoted && strings.EqualFold(p.tokens[p.pos].text, op)
+}
+
+func (p *queryParser) parseOr() (*query, error) {
+	var children []*query
+	for {
+		q, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		children = append(children, q)
+
+		if !p.peekOperator("or") {
+			break
+		}
+		p.pos++
+	}
+
+	if len(children) == 1 {
+		return children[0], nil
+	}
+	return &query{op: queryOr, children: children}, nil
+}
+
+func (p *queryParser) parseAnd() (*query, error) {
+	var children []*query
+	for p.pos < len(p.tokens) && !p.peekOperator("or") && !p.peekOperator(")") {
+		if p.peekOperator("and") {
+			p.pos++
+			continue
+		}
+
+		q, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		if n := len(children); q.word && n > 0 && children[n-1].word {
+			children[n-1].value += " " + q.value
+			continue
+		}
+		children = append(children, q)
+	}
+
+	switch len(children) {
+	case 0:
+		if p.pos < len(p.tokens) {
+			return nil, fmt.Errorf("unexpected %q in query", p.tokens[p.pos].text)
+		}
+		return nil, fmt.Errorf("missing a term at the end of query")
+	case 1:
+		return children[0], nil
+	}
+	return &query{op: queryAnd, children: children}, nil
+}
+
+func (p *queryParser) parseUnary() (*query, error) {
+	t := p.tokens[p.pos]
+
+	switch {
+	case p.peekOperator("not"):
+		p.pos++
+		if p.pos >= len(p.tokens) {
+			return nil, fmt.Errorf("missing a term after not")
+		}
+		q, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &query{op: queryNot, children: []*query{q}}, nil
+
+	case !t.quoted && t.text == "-" && p.pos+1 < len(p.tokens) && !p.tokens[p.pos+1].quoted && p.tokens[p.pos+1].text == "(":
+		// -(a or b)
+		p.pos++
+		q, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &query{op: queryNot, children: []*query{q}}, nil
+
+	case !t.quoted && len(t.text) > 1 && t.text[0] == '-':
+		p.tokens[p.pos].text = t.text[1:]
+		q, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &query{op: queryNot, children: []*query{q}}, nil
+
+	case p.peekOperator("("):
+		p.pos++
+		q, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if !p.peekOperator(")") {
+			return nil, fmt.Errorf("missing ) in query")
+		}
+		p.pos++
+		return q, nil
+	}
+
+	p.pos++
+	return p.parseTerm(t)
+}
+
+func (p *queryParser) parseTerm(t queryToken) (*query, error) {
+	if colon := strings.Index(t.text, ":"); colon != -1 {
+		name := strings.ToLower(t.text[:colon])
+		if conv, found := queryKeys[name]; found {
+			key, value, err := conv(t.text[colon+1:])
+			if err != nil {
+				return nil, err
+			}
+			return &query{op: queryTerm, key: key, value: value}, nil
+		}
+	}
+
+	return &query{op: queryTerm, key: p.defaultKey, value: t.text, word: !t.quoted}, nil
+}
+
+// searchKeys compiles the query into arguments of SEARCH. A nil query is ALL.
+func (q *query) searchKeys() []interface{} {
+	if q == nil {
+		return []interface{}{"ALL"}
+	}
+	if q.op == queryAnd {
+		var keys []interface{}
+		for _, child := range q.children {
+			keys = append(keys, child.searchKeys()...)
+		}
+		return keys
+	}
+	return q.searchKey()
+}
+
+// searchKey compiles the query into a single search key, grouping ANDed keys in parentheses.
+func (q *query) searchKey() []interface{} {
+	switch q.op {
+	case queryAnd:
+		return []interface{}{imapList(q.searchKeys())}
+
+	case queryOr:
+		// OR takes two keys: OR a OR b c
+		keys := q.children[len(q.children)-1].searchKey()
+		for i := len(q.children) - 2; i >= 0; i-- {
+			keys = append(append([]interface{}{"OR"}, q.children[i].searchKey()...), keys...)
+		}
+		return keys
+
+	case queryNot:
+		return append([]interface{}{"NOT"}, q.children[0].searchKey()...)
+	}
+
+	switch {
+	case q.key == "KEYWORD":
+		// a tag is a keyword or in tagsHeader, where it matches as a substring like any HEADER key
+		header := []interface{}{"HEADER", tagsHeader, imapString(q.value)}
+		if !isKeyword(q.value) {
+			return header
+		}
+		return append([]interface{}{"OR", "KEYWORD", q.value}, header...)
+
+	case q.value == "":
+		return []interface{}{q.key}
+
+	case isNumber(q.value):
+		// LARGER and SMALLER take a number, not a string
+		return []interface{}{q.key, q.value}
+	}
+	return []interface{}{q.key, imapString(q.value)}
+}
+
+func isNumber(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return s != ""
+}
+
+// search returns sorted sequence numbers of the messages matched by the query, in a single SEARCH.
+func (q *query) search(c *imapConn) ([]uint32, error) {
+	keys := q.searchKeys()
+	logTrace("imap", "cmd", "SEARCH", "keys", fmt.Sprint(keys))
+	seqs, err := c.search(false, keys)
+	if err != nil {
+		return nil, fmt.Errorf("failed to search: %v", err)
+	}
+	sortSeqs(seqs, false)
+	return seqs, nil
+}
+
+func seqSet(seqs []uint32) map[uint32]bool {
+	set := make(map[uint32]bool, len(seqs))
+	for _, seq := range seqs {
+		set[seq] = true
+	}
+	return set
+}
+
+// resolveSeqByQuery returns a comma separated sequence set matched by the query src.
+func resolveSeqByQuery(c *imapConn, src string) (string, error) {
+	q, err := parseQuery(src, "SUBJECT")
+	if err != nil {
+		return "", err
+	}
+
+	seqs, err := q.search(c)
+	if err != nil {
+		return "", err
+	}
+	return joinUint32(seqs, ","), nil
+}
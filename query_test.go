@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestQuerySearch(t *testing.T) {
+	testdata := []struct {
+		Src    string
+		Search string
+	}{
+		{Src: "", Search: "SEARCH ALL"},
+		{Src: "会議", Search: "SEARCH CHARSET UTF-8 SUBJECT {6}会議"},
+		// words are a phrase
+		{Src: "foo bar  baz", Search: `SEARCH SUBJECT "foo bar baz"`},
+		{Src: `"foo bar" baz`, Search: `SEARCH SUBJECT "foo bar" SUBJECT "baz"`},
+		{Src: "subject:会議 since:2024-01-05 larger:2k", Search: "SEARCH CHARSET UTF-8 SUBJECT {6}会議 SENTSINCE \"5-Jan-2024\" LARGER 2048"},
+		{Src: "foo not subject:draft body:todo", Search: `SEARCH SUBJECT "foo" NOT SUBJECT "draft" BODY "todo"`},
+		{Src: "before:2024-01-15 -body:done", Search: `SEARCH SENTBEFORE "15-Jan-2024" NOT BODY "done"`},
+		{Src: `(subject:a or subject:b or "foo bar") -body:done`, Search: `SEARCH OR SUBJECT "a" OR SUBJECT "b" SUBJECT "foo bar" NOT BODY "done"`},
+		{Src: `not (a is:read) or subject:"foo bar"`, Search: `SEARCH OR NOT (SUBJECT "a" SEEN) SUBJECT "foo bar"`},
+		{Src: "-(a or b) c", Search: `SEARCH NOT OR SUBJECT "a" SUBJECT "b" SUBJECT "c"`},
+		{Src: "re:hello", Search: `SEARCH SUBJECT "re:hello"`},
+		{Src: "tag:work or tag:仕事", Search: "SEARCH CHARSET UTF-8 OR OR KEYWORD work HEADER X-Pomi-Tags \"work\" HEADER X-Pomi-Tags {6}仕事"},
+		{Src: "is:pinned is:Unread", Search: "SEARCH FLAGGED UNSEEN"},
+	}
+
+	var steps []fakeIMAPStep
+	for _, d := range testdata {
+		steps = append(steps, fakeIMAPStep{Command: d.Search, Reply: []string{"* SEARCH 3 1", "TAG OK SEARCH completed"}})
+	}
+	c := startFakeIMAP(t, time.Second, steps)
+
+	for _, d := range testdata {
+		q, err := parseQuery(d.Src, "SUBJECT")
+		if err != nil {
+			t.Errorf("parseQuery(%q): %v", d.Src, err)
+			continue
+		}
+		got, err := q.search(c)
+		if err != nil {
+			t.Errorf("search(%q): %v", d.Src, err)
+			continue
+		}
+		if fmt.Sprint(got) != "[1 3]" {
+			t.Errorf("search(%q) = %v", d.Src, got)
+		}
+	}
+}
+
+func TestParseQueryError(t *testing.T) {
+	for _, src := range []string{"since:yesterday", "larger:big", "(a", "a or", `"a`, "not", ")", "is:starred"} {
+		if _, err := parseQuery(src, "SUBJECT"); err == nil {
+			t.Errorf("parseQuery(%q) must fail", src)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRename(t *testing.T) {
+	config, ic := getTestFixtures()
+	setupTestBox(t, config, ic)
+
+	ic.Append(config.IMAP.Box, nil, *makeMailMessage("test", "body", time.Now()))
+	ic.Append(config.IMAP.Box, nil, *makeMailMessage("テスト", "", time.Now()))
+	msgsExistsExactly(t, ic, []string{"test", "テスト"})
+
+	if _, err := renameMessage(ic, config.IMAP.Box, "aaaa", "bbbb", false); err == nil {
+		t.Errorf("renaming a missing message must fail")
+	}
+
+	if _, err := renameMessage(ic, config.IMAP.Box, "test", "テスト", false); err == nil {
+		t.Errorf("renaming to an existing subject must fail")
+	}
+	msgsExistsExactly(t, ic, []string{"test", "テスト"})
+
+	if _, err := renameMessage(ic, config.IMAP.Box, "test", "テスト2", false); err != nil {
+		t.Errorf("failed to rename: %v", err)
+	}
+	msgsExistsExactly(t, ic, []string{"テスト2", "テスト"})
+
+	if _, err := renameMessage(ic, config.IMAP.Box, "テスト2", "テスト", true); err != nil {
+		t.Errorf("failed to rename: %v", err)
+	}
+	msgsExistsExactly(t, ic, []string{"テスト"})
+
+	teardownTestBox(t, config, ic)
+	ic.Logout()
+}
+
+func TestRenameSplitMemo(t *testing.T) {
+	config, ic := getTestFixtures()
+	setupTestBox(t, config, ic)
+
+	parts := [][]byte{[]byte("part 1\n"), []byte("part 2\n")}
+	if err := putParts(ic, config.IMAP.Box, config.IMAP.User, "memo", "txt", nil, false, parts, time.Now()); err != nil {
+		t.Fatalf("failed to put parts: %v", err)
+	}
+	msgsExistsExactly(t, ic, []string{"memo (1/2)", "memo (2/2)"})
+
+	if _, err := renameMessage(ic, config.IMAP.Box, "memo (1/2)", "part", false); err == nil {
+		t.Errorf("renaming a part must fail")
+	}
+
+	if _, err := renameMessage(ic, config.IMAP.Box, "memo", "メモ", false); err != nil {
+		t.Errorf("failed to rename: %v", err)
+	}
+	msgsExistsExactly(t, ic, []string{"メモ (1/2)", "メモ (2/2)"})
+
+	renamings, _, err := findPartRenamings(ic, "メモ", "x")
+	if err != nil || len(renamings) != 2 {
+		t.Errorf("parts must have the new parent: %v, %v", renamings, err)
+	}
+
+	teardownTestBox(t, config, ic)
+	ic.Logout()
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultRetryAttempts = 4
+	defaultRetryWait     = 1  // seconds
+	defaultRetryMaxWait  = 30 // seconds
+)
+
+var (
+	jitterMu   sync.Mutex
+	jitterRand = rand.New(rand.NewSource(time.Now().UnixNano()))
+)
+
+// retryPolicy is [RETRY] of the config with defaults filled.
+type retryPolicy struct {
+	Attempts int
+	Wait     time.Duration
+	MaxWait  time.Duration
+}
+
+func (c *config) retryPolicy() retryPolicy {
+	p := retryPolicy{
+		Attempts: c.RETRY.Attempts,
+		Wait:     time.Duration(c.RETRY.Wait) * time.Second,
+		MaxWait:  time.Duration(c.RETRY.MaxWait) * time.Second,
+	}
+	if p.Attempts <= 0 {
+		p.Attempts = defaultRetryAttempts
+	}
+	if p.Wait <= 0 {
+		p.Wait = defaultRetryWait * time.Second
+	}
+	if p.MaxWait <= 0 {
+		p.MaxWait = defaultRetryMaxWait * time.Second
+	}
+	if p.MaxWait < p.Wait {
+		p.MaxWait = p.Wait
+	}
+	return p
+}
+
+// backoff returns the wait before the (n+1)th attempt (n >= 1).
+// It doubles from Wait up to MaxWait, with up to 50% of jitter subtracted
+// so that workers do not reconnect all at once.
+func (p retryPolicy) backoff(n int) time.Duration {
+	d := p.Wait
+	if d <= 0 {
+		return 0
+	}
+	for i := 1; i < n && d < p.MaxWait; i++ {
+		d *= 2
+	}
+	if d > p.MaxWait {
+		d = p.MaxWait
+	}
+
+	jitterMu.Lock()
+	j := time.Duration(jitterRand.Int63n(int64(d)/2 + 1))
+	jitterMu.Unlock()
+
+	return d - j
+}
+
+// retry calls f until it succeeds, fails with a permanent error, the attempts of config run out, or ctx is done.
+// f must be safe to call again after a failure; it is expected to reconnect by itself.
+func retry(ctx context.Context, config *config, name string, f func() error) error {
+	return config.retryPolicy().do(ctx, name, f)
+}
+
+// do is retry with p. The zero retryPolicy calls f just once.
+func (p retryPolicy) do(ctx context.Context, name string, f func() error) error {
+	var err error
+	for n := 1; ; n++ {
+		if ctx.Err() != nil {
+			if err == nil {
+				err = ctx.Err()
+			}
+			return err
+		}
+
+		err = f()
+		if err == nil || !isTransient(err) || n >= p.Attempts {
+			return err
+		}
+
+		wait := p.backoff(n)
+		if isThrottled(err) {
+			wait = p.MaxWait
+		}
+		logWarn("retry", "name", name, "err", err, "wait", wait, "attempt", n)
+		fmt.Fprintf(os.Stderr, "%v: %v (retrying in %v, %d/%d)\n", name, err, wait.Round(time.Millisecond), n, p.Attempts-1)
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+		}
+	}
+}
+
+// permanentErrors are never retried even if they look transient.
+var permanentErrors = []string{
+	"authenticationfailed",
+	"invalid credentials",
+	"authentication failed",
+	"no such host",
+	"certificate",
+}
+
+// throttledErrors tell that the server limits us; retrying soon would not help.
+var throttledErrors = []string{
+	"throttled",
+	"too many simultaneous connections",
+	"bandwidth limits",
+	"[overquota]",
+}
+
+var transientErrors = []string{
+	"timeout",
+	"timed out",
+	"connection reset",
+	"broken pipe",
+	"eof",
+	"use of closed network connection",
+	"connection refused",
+	"temporary",
+	"try again",
+	"unavailable",
+}
+
+// isTransient reports whether err is worth retrying after reconnection.
+// Server responses are not typed, so it judges by the message.
+func isTransient(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	msg := strings.ToLower(err.Error())
+	if containsAny(msg, permanentErrors) {
+		return false
+	}
+	return containsAny(msg, throttledErrors) || containsAny(msg, transientErrors)
+}
+
+func isThrottled(err error) bool {
+	return err != nil && containsAny(strings.ToLower(err.Error()), throttledErrors)
+}
+
+func containsAny(s string, subs []string) bool {
+	for _, sub := range subs {
+		if strings.Contains(s, sub) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestIsTransient(t *testing.T) {
+	cases := []struct {
+		err  string
+		want bool
+	}{
+		{"read tcp 1.2.3.4:993: i/o timeout", true},
+		{"write: broken pipe", true},
+		{"EOF", true},
+		{"NO [UNAVAILABLE] Temporary System Error", true},
+		{"NO [THROTTLED] Account exceeded command or bandwidth limits", true},
+		{"NO [AUTHENTICATIONFAILED] Invalid credentials (Failure)", false},
+		{"NO [NONEXISTENT] Unknown Mailbox", false},
+	}
+	for _, c := range cases {
+		if got := isTransient(errors.New(c.err)); got != c.want {
+			t.Errorf("isTransient(%q) = %v, want %v", c.err, got, c.want)
+		}
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	p := retryPolicy{Attempts: 5, Wait: time.Second, MaxWait: 3 * time.Second}
+	for n, max := range []time.Duration{time.Second, 2 * time.Second, 3 * time.Second, 3 * time.Second} {
+		d := p.backoff(n + 1)
+		if d < max/2 || d > max {
+			t.Errorf("backoff(%v) = %v, want [%v, %v]", n+1, d, max/2, max)
+		}
+	}
+}
+
+func TestRetryDo(t *testing.T) {
+	p := retryPolicy{Attempts: 3}
+
+	calls := 0
+	err := p.do(context.Background(), "test", func() error {
+		calls++
+		return errors.New("connection reset by peer")
+	})
+	if err == nil || calls != 3 {
+		t.Errorf("transient: err=%v, calls=%v", err, calls)
+	}
+
+	calls = 0
+	err = p.do(context.Background(), "test", func() error {
+		calls++
+		return errors.New("Invalid credentials")
+	})
+	if err == nil || calls != 1 {
+		t.Errorf("permanent: err=%v, calls=%v", err, calls)
+	}
+}
@@ -0,0 +1,427 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+const defaultIndexFileName = "pomi_index.json"
+
+// subjectTermWeight multiplies term frequencies found in subjects.
+const subjectTermWeight = 3
+
+type indexedDoc struct {
+	Subject string    `json:"subject"`
+	Ext     string    `json:"ext"`
+	Date    time.Time `json:"date"`
+	Body    string    `json:"body"`
+	Len     int       `json:"len"`
+}
+
+// searchIndex is a local inverted index over memos, keyed by subject.
+type searchIndex struct {
+	Docs     map[string]*indexedDoc    `json:"docs"`
+	Postings map[string]map[string]int `json:"postings"` // term -> subject -> weighted term frequency
+
+	path  string
+	dirty bool
+	mu    sync.Mutex
+}
+
+type searchHit struct {
+	Doc     *indexedDoc
+	Score   float64
+	Snippet string
+}
+
+func indexPath(config *config) string {
+	if config.INDEX.Path != "" {
+		return config.INDEX.Path
+	}
+	return filepath.Join(filepath.Dir(config.path), defaultIndexFileName)
+}
+
+// indexMessage adds a message to the index of config.
+// Errors are just reported because the index can be rebuilt at any time.
+func indexMessage(config *config, subject, ext string, tm time.Time, body []byte) {
+	idx, err := openSearchIndex(indexPath(config))
+	if err == nil {
+		idx.add(subject, ext, tm, body)
+		err = idx.save()
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+	}
+}
+
+// openSearchIndex loads the index at path. A missing file results in an empty index.
+func openSearchIndex(path string) (*searchIndex, error) {
+	idx := &searchIndex{
+		Docs:     make(map[string]*indexedDoc),
+		Postings: make(map[string]map[string]int),
+		path:     path,
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return idx, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read index %q: %v", path, err)
+	}
+
+	if err := json.Unmarshal(data, idx); err != nil {
+		return nil, fmt.Errorf("broken index %q (try search --rebuild): %v", path, err)
+	}
+	if idx.Docs == nil {
+		idx.Docs = make(map[string]*indexedDoc)
+	}
+	if idx.Postings == nil {
+		idx.Postings = make(map[string]map[string]int)
+	}
+
+	return idx, nil
+}
+
+// save writes the index if it has been modified.
+func (idx *searchIndex) save() error {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	if !idx.dirty {
+		return nil
+	}
+
+	data, err := json.Marshal(idx)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(idx.path, data, 0600); err != nil {
+		return fmt.Errorf("failed to write index %q: %v", idx.path, err)
+	}
+	idx.dirty = false
+
+	return nil
+}
+
+// clear removes all documents.
+func (idx *searchIndex) clear() {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	idx.Docs = make(map[string]*indexedDoc)
+	idx.Postings = make(map[string]map[string]int)
+	idx.dirty = true
+}
+
+// add (re)indexes a memo.
+func (idx *searchIndex) add(subject, ext string, tm time.Time, body []byte) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	idx.removeLocked(subject)
+
+	text := string(bytes.TrimPrefix(body, utf8BOM))
+	tf := make(map[string]int)
+	for _, t := range indexTerms(subject) {
+		tf[t] += subjectTermWeight
+	}
+	for _, t := range indexTerms(text) {
+		tf[t]++
+	}
+	length := len(tokenize(text))
+
+	idx.Docs[subject] = &indexedDoc{
+		Subject: subject,
+		Ext:     ext,
+		Date:    tm,
+		Body:    text,
+		Len:     length,
+	}
+	for t, n := range tf {
+		p, found := idx.Postings[t]
+		if !found {
+			p = make(map[string]int)
+			idx.Postings[t] = p
+		}
+		p[subject] = n
+	}
+	idx.dirty = true
+}
+
+// remove drops a memo from the index.
+func (idx *searchIndex) remove(subject string) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	idx.removeLocked(subject)
+}
+
+func (idx *searchIndex) removeLocked(subject string) {
+	doc, found := idx.Docs[subject]
+	if !found {
+		return
+	}
+
+	for _, t := range append(indexTerms(doc.Subject), indexTerms(doc.Body)...) {
+		if p, found := idx.Postings[t]; found {
+			delete(p, subject)
+			if len(p) == 0 {
+				delete(idx.Postings, t)
+			}
+		}
+	}
+	delete(idx.Docs, subject)
+	idx.dirty = true
+}
+
+// writer returns a MsgWriter that passes each message to w and indexes it.
+// Messages are local files in f, and indexed as put reads them back: in UTF-8 without front matter.
+func (idx *searchIndex) writer(f localFormat, w MsgWriter) MsgWriter {
+	return func(syncDirPath, subject, ext string, tm time.Time, r io.Reader) error {
+		data, err := ioutil.ReadAll(r)
+		if err != nil {
+			return fmt.Errorf("on subject[%v]: body reading error: %v", subject, err)
+		}
+
+		err = w(syncDirPath, subject, ext, tm, bytes.NewReader(data))
+		if err != nil && err != errUnchanged {
+			return err
+		}
+
+		text, terr := f.toRemote(subject, data)
+		if terr != nil {
+			logDebug("index", "subject", subject, "err", terr)
+			return err
+		}
+		if _, body, ferr := parseFrontMatter(text); ferr == nil {
+			text = body
+		}
+		idx.add(subject, ext, tm, text)
+		return err
+	}
+}
+
+// search returns documents containing all terms of query, ranked by BM25.
+func (idx *searchIndex) search(query string) []searchHit {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	terms := uniqueStrings(tokenize(query))
+	if len(terms) == 0 || len(idx.Docs) == 0 {
+		return nil
+	}
+
+	const k1, b = 1.2, 0.75
+
+	avgLen := 0.0
+	for _, d := range idx.Docs {
+		avgLen += float64(d.Len)
+	}
+	avgLen /= float64(len(idx.Docs))
+	if avgLen == 0 {
+		avgLen = 1
+	}
+
+	scores := make(map[string]float64)
+	for i, t := range terms {
+		p := idx.Postings[t]
+		if len(p) == 0 {
+			return nil
+		}
+
+		idf := math.Log(1 + (float64(len(idx.Docs))-float64(len(p))+0.5)/(float64(len(p))+0.5))
+		next := make(map[string]float64)
+		for subject, n := range p {
+			prev, found := scores[subject]
+			if i > 0 && !found {
+				continue // AND
+			}
+			tf := float64(n)
+			dl := float64(idx.Docs[subject].Len)
+			next[subject] = prev + idf*tf*(k1+1)/(tf+k1*(1-b+b*dl/avgLen))
+		}
+		scores = next
+		if len(scores) == 0 {
+			return nil
+		}
+	}
+
+	words := strings.Fields(query)
+	hits := make([]searchHit, 0, len(scores))
+	for subject, score := range scores {
+		doc := idx.Docs[subject]
+		hits = append(hits, searchHit{
+			Doc:     doc,
+			Score:   score,
+			Snippet: makeSnippet(doc.Body, words, 30),
+		})
+	}
+	sort.Slice(hits, func(i, j int) bool {
+		if hits[i].Score != hits[j].Score {
+			return hits[i].Score > hits[j].Score
+		}
+		return hits[i].Doc.Date.After(hits[j].Doc.Date)
+	})
+
+	return hits
+}
+
+// tokenize splits s into lower-cased words.
+// Runs of CJK characters are split into overlapping bigrams.
+func tokenize(s string) []string {
+	return tokenizeWith(s, false)
+}
+
+// indexTerms is tokenize plus every CJK character, for a one-character query to match.
+func indexTerms(s string) []string {
+	return tokenizeWith(s, true)
+}
+
+func tokenizeWith(s string, unigrams bool) []string {
+	var tokens []string
+
+	var word []rune
+	var cjk []rune
+
+	flushWord := func() {
+		if len(word) > 0 {
+			tokens = append(tokens, string(word))
+			word = word[:0]
+		}
+	}
+	flushCJK := func() {
+		switch {
+		case len(cjk) == 1:
+			tokens = append(tokens, string(cjk))
+		case len(cjk) > 1:
+			for i := 0; i+1 < len(cjk); i++ {
+				tokens = append(tokens, string(cjk[i:i+2]))
+			}
+			if unigrams {
+				for _, r := range cjk {
+					tokens = append(tokens, string(r))
+				}
+			}
+		}
+		cjk = cjk[:0]
+	}
+
+	for _, r := range s {
+		r = normalizeRune(r)
+
+		switch {
+		case isCJK(r):
+			flushWord()
+			cjk = append(cjk, r)
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			flushCJK()
+			word = append(word, unicode.ToLower(r))
+		default:
+			flushWord()
+			flushCJK()
+		}
+	}
+	flushWord()
+	flushCJK()
+
+	return tokens
+}
+
+// normalizeRune maps full-width ASCII variants to ASCII.
+func normalizeRune(r rune) rune {
+	if 0xff01 <= r && r <= 0xff5e {
+		return r - 0xfee0
+	}
+	return r
+}
+
+func isCJK(r rune) bool {
+	return unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana, unicode.Hangul) ||
+		r == 'ー' || r == '々'
+}
+
+func uniqueStrings(ss []string) []string {
+	seen := make(map[string]bool, len(ss))
+	result := make([]string, 0, len(ss))
+	for _, s := range ss {
+		if !seen[s] {
+			seen[s] = true
+			result = append(result, s)
+		}
+	}
+	return result
+}
+
+// makeSnippet cuts out text around the first occurrence of words,
+// wrapping each occurrence in \x00 and \x01 to be highlighted later.
+func makeSnippet(body string, words []string, width int) string {
+	lower := strings.ToLower(body)
+	if len(lower) != len(body) {
+		// byte offsets would not match
+		lower = body
+	}
+
+	pos := -1
+	for _, w := range words {
+		if p := strings.Index(lower, strings.ToLower(w)); p != -1 && (pos == -1 || p < pos) {
+			pos = p
+		}
+	}
+	if pos == -1 {
+		pos = 0
+	}
+
+	start := pos
+	for n := 0; start > 0 && n < width; n++ {
+		_, size := utf8.DecodeLastRuneInString(body[:start])
+		start -= size
+	}
+	end := pos
+	for n := 0; end < len(body) && n < width*2; n++ {
+		_, size := utf8.DecodeRuneInString(body[end:])
+		end += size
+	}
+
+	snippet := body[start:end]
+	lowerSnippet := lower[start:end]
+
+	buff := new(strings.Builder)
+	for i := 0; i < len(snippet); {
+		matched := ""
+		for _, w := range words {
+			lw := strings.ToLower(w)
+			if lw != "" && strings.HasPrefix(lowerSnippet[i:], lw) && len(lw) > len(matched) {
+				matched = lw
+			}
+		}
+		if matched != "" {
+			buff.WriteString("\x00" + snippet[i:i+len(matched)] + "\x01")
+			i += len(matched)
+			continue
+		}
+		_, size := utf8.DecodeRuneInString(snippet[i:])
+		buff.WriteString(snippet[i : i+size])
+		i += size
+	}
+
+	s := strings.Join(strings.Fields(buff.String()), " ")
+	if start > 0 {
+		s = "..." + s
+	}
+	if end < len(body) {
+		s += "..."
+	}
+	return s
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTokenize(t *testing.T) {
+	testdata := []struct {
+		Src  string
+		Want []string
+	}{
+		{Src: "Hello, World", Want: []string{"hello", "world"}},
+		{Src: "会議録", Want: []string{"会議", "議録"}},
+		{Src: "今日はＴＯＤＯを確認", Want: []string{"今日", "日は", "todo", "を確", "確認"}},
+		{Src: "字", Want: []string{"字"}},
+	}
+
+	for _, d := range testdata {
+		if got := tokenize(d.Src); !reflect.DeepEqual(got, d.Want) {
+			t.Errorf("tokenize(%q) = %q, want %q", d.Src, got, d.Want)
+		}
+	}
+	if got, want := indexTerms("会議録 memo"), []string{"会議", "議録", "会", "議", "録", "memo"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("indexTerms = %q, want %q", got, want)
+	}
+}
+
+func TestSearchIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pomi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "index.json")
+
+	idx, err := openSearchIndex(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	idx.add("会議メモ", "txt", now, []byte("\xef\xbb\xbf来週の会議の議題: TODO 予算"))
+	idx.add("日記", "txt", now, []byte("今日は会議がなかった"))
+	idx.add("買い物", "md", now, []byte("牛乳、パン"))
+	if err := idx.save(); err != nil {
+		t.Fatal(err)
+	}
+
+	idx, err = openSearchIndex(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hits := idx.search("会議")
+	if len(hits) != 2 || hits[0].Doc.Subject != "会議メモ" {
+		t.Errorf("wrong hits for 会議: %v", hits)
+	}
+	if !strings.Contains(hits[0].Snippet, "\x00会議\x01") {
+		t.Errorf("snippet is not highlighted: %q", hits[0].Snippet)
+	}
+
+	if hits := idx.search("会議 todo"); len(hits) != 1 || hits[0].Doc.Subject != "会議メモ" {
+		t.Errorf("wrong hits for 会議 todo: %v", hits)
+	}
+
+	if hits := idx.search("議"); len(hits) != 2 {
+		t.Errorf("wrong hits for 議: %v", hits)
+	}
+	if hits := idx.search("乳"); len(hits) != 1 || hits[0].Doc.Subject != "買い物" {
+		t.Errorf("wrong hits for 乳: %v", hits)
+	}
+
+	idx.add("会議メモ", "txt", now, []byte("中止"))
+	if hits := idx.search("予算"); len(hits) != 0 {
+		t.Errorf("stale postings: %v", hits)
+	}
+
+	idx.remove("日記")
+	if hits := idx.search("会議"); len(hits) != 1 || hits[0].Doc.Subject != "会議メモ" {
+		t.Errorf("wrong hits after remove: %v", hits)
+	}
+	if hits := idx.search("日"); len(hits) != 0 {
+		t.Errorf("stale unigrams: %v", hits)
+	}
+
+	// indexed as converted back from a local file
+	local := localFormat{Encoding: "shift_jis", LineEnding: "crlf", StripBOM: true}
+	discard := func(string, string, string, time.Time, io.Reader) error { return nil }
+	w := local.writer(idx.writer(local, discard))
+	if err := w(".", "日報", "txt", now, strings.NewReader("\ufeff---\ntitle: 日報\ntags: [work]\n---\n晴れ\n")); err != nil {
+		t.Fatal(err)
+	}
+	if hits := idx.search("晴れ"); len(hits) != 1 || hits[0].Doc.Body != "晴れ\r\n" {
+		t.Errorf("wrong hits for 晴れ: %v", hits)
+	}
+	if hits := idx.search("work"); len(hits) != 0 {
+		t.Errorf("front matter indexed: %v", hits)
+	}
+}
@@ -0,0 +1,390 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/mail"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/shu-go/imapclient"
+)
+
+// Headers linking parts of a memo split by put --split.
+const (
+	partHeader   = "X-Pomi-Part"   // "i/n"
+	parentHeader = "X-Pomi-Parent" // the subject of the whole memo
+)
+
+func partSubject(subject string, i, n int) string {
+	return fmt.Sprintf("%s (%d/%d)", subject, i, n)
+}
+
+var partSubjectPattern = regexp.MustCompile(`^(.*) \((\d+)/(\d+)\)$`)
+
+// parsePart returns the parent subject and the position of a part message.
+// ok is false if msg is not a part.
+func parsePart(msg *mail.Message) (parent string, i, n int, ok bool) {
+	parent = decodeHeader(msg.Header.Get(parentHeader))
+	if parent == "" {
+		return "", 0, 0, false
+	}
+
+	var err error
+	pos := msg.Header.Get(partHeader)
+	if sep := strings.IndexByte(pos, '/'); sep != -1 {
+		i, err = strconv.Atoi(pos[:sep])
+		if err == nil {
+			n, err = strconv.Atoi(pos[sep+1:])
+		}
+	} else if m := partSubjectPattern.FindStringSubmatch(msg.Header.Get("Subject")); m != nil {
+		i, _ = strconv.Atoi(m[2])
+		n, err = strconv.Atoi(m[3])
+	} else {
+		return "", 0, 0, false
+	}
+	if err != nil || i < 1 || n < 1 || i > n {
+		return "", 0, 0, false
+	}
+	return parent, i, n, true
+}
+
+// splitMemo splits body (without BOM) into parts of at most max characters.
+// It cuts at paragraph boundaries, then line boundaries, then anywhere,
+// so that joining the parts results in body.
+func splitMemo(body []byte, max int) [][]byte {
+	body = bytes.TrimPrefix(body, utf8BOM)
+	if max <= 0 || utf8.RuneCount(body) <= max {
+		return [][]byte{body}
+	}
+
+	var parts [][]byte
+	var cur []byte
+	curLen := 0
+	add := func(seg []byte) {
+		n := utf8.RuneCount(seg)
+		if curLen > 0 && curLen+n > max {
+			parts = append(parts, cur)
+			cur, curLen = nil, 0
+		}
+		cur = append(cur, seg...)
+		curLen += n
+	}
+
+	for _, para := range splitAfterParagraphs(body) {
+		if utf8.RuneCount(para) <= max {
+			add(para)
+			continue
+		}
+		for _, line := range bytes.SplitAfter(para, []byte("\n")) {
+			if len(line) == 0 {
+				continue
+			}
+			if utf8.RuneCount(line) <= max {
+				add(line)
+				continue
+			}
+			for _, chunk := range splitRunes(line, max) {
+				add(chunk)
+			}
+		}
+	}
+	if len(cur) > 0 {
+		parts = append(parts, cur)
+	}
+
+	return parts
+}
+
+// splitAfterParagraphs splits body after each run of blank lines.
+func splitAfterParagraphs(body []byte) [][]byte {
+	var paras [][]byte
+	start := 0
+	blank := false
+	lines := bytes.SplitAfter(body, []byte("\n"))
+	pos := 0
+	for _, line := range lines {
+		isBlank := len(bytes.TrimRight(line, "\r\n")) == 0 && len(line) > 0
+		if blank && !isBlank && pos > start {
+			paras = append(paras, body[start:pos])
+			start = pos
+		}
+		blank = isBlank
+		pos += len(line)
+	}
+	if start < len(body) {
+		paras = append(paras, body[start:])
+	}
+	return paras
+}
+
+func splitRunes(s []byte, max int) [][]byte {
+	var chunks [][]byte
+	for len(s) > 0 {
+		n, size := 0, 0
+		for size < len(s) && n < max {
+			_, l := utf8.DecodeRune(s[size:])
+			size += l
+			n++
+		}
+		chunks = append(chunks, s[:size])
+		s = s[size:]
+	}
+	return chunks
+}
+
+// putParts puts a memo as parts, and deletes the whole memo and parts of older splits.
+// extra headers are added to every part. See putMessageUnlessUnchanged for frontMatter.
+// It returns errUnchanged if all parts are already in the box.
+func putParts(c *imapConn, box, from, subject, ext string, extra mail.Header, frontMatter bool, parts [][]byte, tm time.Time) error {
+	keep := make(map[string]bool)
+	unchanged := true
+	for i, part := range parts {
+		name := subject
+		partExtra := make(mail.Header)
+		for k, v := range extra {
+			partExtra[k] = v
+		}
+		if len(parts) > 1 {
+			name = partSubject(subject, i+1, len(parts))
+			partExtra[partHeader] = []string{fmt.Sprintf("%d/%d", i+1, len(parts))}
+			partExtra[parentHeader] = []string{subject}
+		}
+		keep[name] = true
+
+		err := putMessageUnlessUnchanged(c, box, from, name, ext, partExtra, frontMatter, bytes.NewReader(part), tm)
+		if err == errUnchanged {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		unchanged = false
+	}
+
+	deleted, err := deleteStaleParts(c, subject, keep)
+	if err != nil {
+		return err
+	}
+	if unchanged && deleted == 0 {
+		return errUnchanged
+	}
+	return nil
+}
+
+// memoPart is a part of a memo split by put --split.
+type memoPart struct {
+	Seq  uint32
+	I, N int
+	Msg  *mail.Message // the text part, only headers
+}
+
+// findParts returns the parts of the memo subject, in seq order.
+func findParts(c *imapConn, subject string) ([]memoPart, error) {
+	seqs, err := c.Search("SUBJECT", subject)
+	if err != nil || len(seqs) == 0 {
+		return nil, err
+	}
+	mm, err := c.Fetch(joinUint32(seqs, ","), true)
+	if err != nil {
+		return nil, err
+	}
+
+	var parts []memoPart
+	for seq, m := range mm {
+		hm, err := imapclient.DecodeMailMessage(m, true)
+		if err != nil || len(hm) == 0 {
+			continue
+		}
+		msg := pickupTextPartMessage(hm)
+		parent, i, n, ok := parsePart(msg)
+		if !ok || parent != subject {
+			continue
+		}
+		parts = append(parts, memoPart{Seq: seq, I: i, N: n, Msg: msg})
+	}
+	sort.Slice(parts, func(i, j int) bool {
+		return parts[i].Seq < parts[j].Seq
+	})
+	return parts, nil
+}
+
+// readMemo returns the text part of the memo subject, joining its parts if split is true.
+// It returns nil if there is no such memo.
+func readMemo(c *imapConn, subject string) (msg *mail.Message, split bool, err error) {
+	seq, msg, err := findMessageBySubject(c, subject)
+	if err != nil || seq != 0 {
+		return msg, false, err
+	}
+
+	parts, err := findParts(c, subject)
+	if err != nil || len(parts) == 0 {
+		return nil, false, err
+	}
+	seqs := make([]uint32, len(parts))
+	for i, p := range parts {
+		seqs[i] = p.Seq
+	}
+	mm, err := c.Fetch(joinUint32(seqs, ","))
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to fetch %q: %v", subject, err)
+	}
+
+	asm := newPartAssembler()
+	for _, p := range parts {
+		m, found := mm[p.Seq]
+		if !found {
+			continue
+		}
+		textMsg, err := decodeMessageAsTextMessage(m, false)
+		if err != nil {
+			return nil, false, err
+		}
+		if joined, err := asm.add(subject, p.I, p.N, textMsg); err != nil {
+			return nil, false, err
+		} else if joined != nil {
+			msg = joined
+		}
+	}
+	if msg == nil {
+		return nil, false, fmt.Errorf("some parts of %q are missing", subject)
+	}
+	return msg, true, nil
+}
+
+// deleteStaleParts deletes the memo subject and its parts except those in keep.
+func deleteStaleParts(c *imapConn, subject string, keep map[string]bool) (int, error) {
+	expungeMu.Lock()
+	defer expungeMu.Unlock()
+
+	seqs, err := c.Search("SUBJECT", subject)
+	if err != nil || len(seqs) == 0 {
+		return 0, err
+	}
+	mm, err := c.Fetch(joinUint32(seqs, ","), true)
+	if err != nil {
+		return 0, err
+	}
+
+	var stale []uint32
+	for seq, m := range mm {
+		hm, err := imapclient.DecodeMailMessage(m, true)
+		if err != nil || len(hm) == 0 {
+			continue
+		}
+		h := hm[0].Header
+		s := h.Get("Subject")
+		if keep[s] {
+			continue
+		}
+		if s == subject || decodeHeader(h.Get(parentHeader)) == subject {
+			stale = append(stale, seq)
+		}
+	}
+	if len(stale) == 0 {
+		return 0, nil
+	}
+
+	logTrace("imap", "cmd", "STORE +FLAGS \\Deleted / EXPUNGE", "seqset", joinUint32(stale, ","), "subject", subject)
+	err = critical(func() error {
+		if err := c.Store(joinUint32(stale, ","), "+FLAGS", []string{imapclient.FlagDeleted}); err != nil {
+			return err
+		}
+		return c.Expunge()
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete old parts of %q: %v", subject, err)
+	}
+	return len(stale), nil
+}
+
+type partGroup struct {
+	n     int
+	parts map[int]*mail.Message
+}
+
+// partAssembler collects parts of memos until all of each are got.
+type partAssembler struct {
+	mu      sync.Mutex
+	groups  map[string]*partGroup
+	orphans []*mail.Message // parts of another split of the same memo
+}
+
+func newPartAssembler() *partAssembler {
+	return &partAssembler{groups: make(map[string]*partGroup)}
+}
+
+// add keeps a part of parent.
+// When all parts of parent are there, it returns them joined as one message.
+func (a *partAssembler) add(parent string, i, n int, msg *mail.Message) (*mail.Message, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	g, found := a.groups[parent]
+	if found && g.n != n {
+		for _, m := range g.parts {
+			a.orphans = append(a.orphans, m)
+		}
+		found = false
+	}
+	if !found {
+		g = &partGroup{n: n, parts: make(map[int]*mail.Message)}
+		a.groups[parent] = g
+	}
+	g.parts[i] = msg
+	if len(g.parts) < n {
+		return nil, nil
+	}
+	delete(a.groups, parent)
+
+	return joinParts(parent, g)
+}
+
+// rest returns parts whose siblings are missing.
+func (a *partAssembler) rest() []*mail.Message {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	msgs := a.orphans
+	for _, g := range a.groups {
+		for _, m := range g.parts {
+			msgs = append(msgs, m)
+		}
+	}
+	a.groups = make(map[string]*partGroup)
+	a.orphans = nil
+	return msgs
+}
+
+func joinParts(parent string, g *partGroup) (*mail.Message, error) {
+	buff := new(bytes.Buffer)
+	for i := 1; i <= g.n; i++ {
+		part := g.parts[i]
+		body, err := ioutil.ReadAll(part.Body)
+		if err != nil {
+			return nil, fmt.Errorf("on subject[%v]: body reading error: %v", part.Header.Get("Subject"), err)
+		}
+		if i > 1 {
+			// every part has its own BOM
+			body = bytes.TrimPrefix(body, utf8BOM)
+		}
+		buff.Write(body)
+	}
+
+	first := g.parts[1]
+	header := make(mail.Header)
+	for k, v := range first.Header {
+		header[k] = v
+	}
+	header["Subject"] = []string{parent}
+	delete(header, partHeader)
+	delete(header, parentHeader)
+
+	return &mail.Message{Header: header, Body: buff}, nil
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/mail"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestSplitMemo(t *testing.T) {
+	body := "para1 line1\r\npara1 line2\r\n\r\npara2\r\n\r\n\r\nあいうえおかきくけこ\r\n"
+
+	cases := []struct {
+		max   int
+		parts []string
+	}{
+		{0, []string{body}},
+		{100, []string{body}},
+		{30, []string{"para1 line1\r\npara1 line2\r\n\r\n", "para2\r\n\r\n\r\nあいうえおかきくけこ\r\n"}},
+		{13, []string{"para1 line1\r\n", "para1 line2\r\n", "\r\npara2\r\n\r\n\r\n", "あいうえおかきくけこ\r\n"}},
+		{4, []string{"para", "1 li", "ne1\r", "\n", "para", "1 li", "ne2\r", "\n\r\n", "para", "2\r\n", "\r\n\r\n", "あいうえ", "おかきく", "けこ\r\n"}},
+	}
+	for _, c := range cases {
+		parts := splitMemo(append(append([]byte(nil), utf8BOM...), body...), c.max)
+
+		var got []string
+		for _, p := range parts {
+			if c.max > 0 && utf8.RuneCount(p) > c.max {
+				t.Errorf("max %d: too long part %q", c.max, p)
+			}
+			got = append(got, string(p))
+		}
+		if strings.Join(got, "|") != strings.Join(c.parts, "|") {
+			t.Errorf("max %d: %q", c.max, got)
+		}
+		if joined := string(bytes.Join(parts, nil)); joined != body {
+			t.Errorf("max %d: joined %q", c.max, joined)
+		}
+	}
+}
+
+func TestPartAssembler(t *testing.T) {
+	part := func(i, n int, body string) *mail.Message {
+		return &mail.Message{
+			Header: mail.Header{
+				"Subject":    []string{partSubject("memo", i, n)},
+				"Date":       []string{"Mon, 02 Jan 2006 15:04:05 +0900"},
+				partHeader:   []string{fmt.Sprintf("%d/%d", i, n)},
+				parentHeader: []string{"memo"},
+			},
+			Body: strings.NewReader(body),
+		}
+	}
+
+	parent, i, n, ok := parsePart(part(2, 3, ""))
+	if !ok || parent != "memo" || i != 2 || n != 3 {
+		t.Fatalf("parsePart = %q, %d, %d, %v", parent, i, n, ok)
+	}
+	if _, _, _, ok := parsePart(&mail.Message{Header: mail.Header{"Subject": []string{"memo (1/2)"}}}); ok {
+		t.Errorf("not a part")
+	}
+
+	a := newPartAssembler()
+	for _, p := range []*mail.Message{part(3, 3, "\ufeffc"), part(1, 3, "\ufeffa"), part(1, 2, "\ufeffx")} {
+		_, i, n, _ := parsePart(p)
+		if m, err := a.add("memo", i, n, p); m != nil || err != nil {
+			t.Fatalf("add %d/%d = %v, %v", i, n, m, err)
+		}
+	}
+	if rest := a.rest(); len(rest) != 3 {
+		t.Errorf("rest: %d", len(rest))
+	}
+
+	for _, i := range []int{2, 3} {
+		a.add("memo", i, 3, part(i, 3, "\ufeff"+string(rune('a'+i-1))))
+	}
+	m, err := a.add("memo", 1, 3, part(1, 3, "\ufeffa"))
+	if err != nil || m == nil {
+		t.Fatalf("joined = %v, %v", m, err)
+	}
+	buff := new(bytes.Buffer)
+	buff.ReadFrom(m.Body)
+	if m.Header.Get("Subject") != "memo" || m.Header.Get(partHeader) != "" || buff.String() != "\ufeffabc" {
+		t.Errorf("joined: %v %q", m.Header, buff.String())
+	}
+	if rest := a.rest(); len(rest) != 0 {
+		t.Errorf("rest after joined: %d", len(rest))
+	}
+}
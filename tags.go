@@ -0,0 +1,324 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/mail"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/shu-go/imapclient"
+)
+
+// tagsHeader holds tags that can't be IMAP keywords, comma separated.
+const tagsHeader = "X-Pomi-Tags"
+
+// Where tags are stored. [TAG] Storage
+const (
+	tagStorageKeyword = "keyword" // IMAP keywords, falling back to tagsHeader
+	tagStorageHeader  = "header"
+)
+
+func tagStorageOf(config *config) (string, error) {
+	switch s := strings.ToLower(config.TAG.Storage); s {
+	case "", tagStorageKeyword:
+		return tagStorageKeyword, nil
+	case tagStorageHeader:
+		return s, nil
+	}
+	return "", fmt.Errorf("unknown tag storage %q (keyword, header)", config.TAG.Storage)
+}
+
+// isKeyword reports whether tag can be an IMAP keyword (an atom, not a system flag).
+func isKeyword(tag string) bool {
+	if tag == "" || tag[0] == '\\' {
+		return false
+	}
+	for i := 0; i < len(tag); i++ {
+		c := tag[i]
+		if c <= 0x20 || c >= 0x7f || strings.IndexByte(`(){%*"\]`, c) != -1 {
+			return false
+		}
+	}
+	return true
+}
+
+// normalizeTag validates a tag name given by the user.
+func normalizeTag(tag string) (string, error) {
+	tag = strings.TrimSpace(tag)
+	if tag == "" {
+		return "", fmt.Errorf("empty tag")
+	}
+	if strings.ContainsAny(tag, ",\r\n") {
+		return "", fmt.Errorf("invalid tag %q (no commas and newlines)", tag)
+	}
+	if tag[0] == '\\' || tag[0] == '$' {
+		return "", fmt.Errorf("invalid tag %q (reserved for system flags)", tag)
+	}
+	return tag, nil
+}
+
+// mergeTags returns tags with add and without remove, sorted and unique.
+func mergeTags(tags, add, remove []string) []string {
+	set := make(map[string]bool)
+	for _, t := range tags {
+		set[t] = true
+	}
+	for _, t := range add {
+		set[t] = true
+	}
+	for _, t := range remove {
+		delete(set, t)
+	}
+
+	merged := make([]string, 0, len(set))
+	for t := range set {
+		merged = append(merged, t)
+	}
+	sort.Strings(merged)
+	return merged
+}
+
+func parseTagsHeader(v string) []string {
+	var tags []string
+	for _, t := range strings.Split(decodeHeader(v), ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			tags = append(tags, t)
+		}
+	}
+	return mergeTags(tags, nil, nil)
+}
+
+func formatTagsHeader(tags []string) string {
+	return encodeHeader(strings.Join(tags, ", "))
+}
+
+// flagTags returns the keywords in flags, which are tags unless system flags (\) or reserved ones ($).
+func flagTags(flags []string) []string {
+	var tags []string
+	for _, f := range flags {
+		if f != "" && f[0] != '\\' && f[0] != '$' {
+			tags = append(tags, f)
+		}
+	}
+	return mergeTags(tags, nil, nil)
+}
+
+// keywordTags returns tags in keywords of each message in seqset.
+func keywordTags(c *imapConn, seqset string) (map[uint32][]string, error) {
+	logTrace("imap", "cmd", "FETCH FLAGS", "seqset", seqset)
+	fetched, err := c.fetchItems(false, seqset, "FLAGS")
+	if err != nil {
+		return nil, err
+	}
+
+	tags := make(map[uint32][]string)
+	for _, f := range fetched {
+		if ts := flagTags(f.Flags); len(ts) > 0 {
+			tags[f.Seq] = ts
+		}
+	}
+	return tags, nil
+}
+
+// allTags returns tags of each message, in keywords and in tagsHeader.
+func allTags(c *imapConn) (map[uint32][]string, error) {
+	tags := make(map[uint32][]string)
+
+	seqs, err := c.Search("ALL")
+	if err != nil || len(seqs) == 0 {
+		return tags, err
+	}
+	fetched, err := c.fetch(false, joinUint32(seqs, ","), true)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range fetched {
+		ts := flagTags(f.Flags)
+		if m, err := mail.ReadMessage(bytes.NewReader(f.Data)); err == nil {
+			if hm, err := imapclient.DecodeMailMessage(m, true); err == nil && len(hm) > 0 {
+				ts = mergeTags(ts, parseTagsHeader(pickupTextPartMessage(hm).Header.Get(tagsHeader)), nil)
+			}
+		}
+		if len(ts) > 0 {
+			tags[f.Seq] = ts
+		}
+	}
+	return tags, nil
+}
+
+// memoSeqs returns the message subject, or the parts of the memo subject split by put --split,
+// in descending seq order not to shift the others by replacing one.
+func memoSeqs(c *imapConn, subject string) ([]uint32, error) {
+	seq, _, err := findMessageBySubject(c, subject)
+	if err != nil {
+		return nil, err
+	}
+	if seq != 0 {
+		return []uint32{seq}, nil
+	}
+
+	parts, err := findParts(c, subject)
+	if err != nil {
+		return nil, err
+	}
+	if len(parts) == 0 {
+		return nil, fmt.Errorf("no message with subject %q", subject)
+	}
+	seqs := make([]uint32, len(parts))
+	for i, p := range parts {
+		seqs[i] = p.Seq
+	}
+	sortSeqs(seqs, true)
+	return seqs, nil
+}
+
+// changeTags adds and removes tags of the message subject, or of all parts of the memo subject
+// split by put --split, and returns its tags after that.
+//
+// Tags are added as keywords if storage is tagStorageKeyword and they can be,
+// otherwise (or if the server refuses keywords) in tagsHeader, which replaces the message.
+func changeTags(c *imapConn, box, subject string, add, remove []string, storage string) ([]string, error) {
+	seqs, err := memoSeqs(c, subject)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []string
+	for _, seq := range seqs {
+		tags, err := changeMessageTags(c, box, subject, seq, add, remove, storage)
+		if err != nil {
+			return nil, err
+		}
+		result = mergeTags(result, tags, nil)
+	}
+	return result, nil
+}
+
+// changeMessageTags is changeTags of the message seq (of the memo subject).
+func changeMessageTags(c *imapConn, box, subject string, seq uint32, add, remove []string, storage string) ([]string, error) {
+	seqStr := strconv.FormatUint(uint64(seq), 10)
+
+	mm, err := c.Fetch(seqStr, true)
+	if err != nil {
+		return nil, err
+	}
+	var inHeader []string
+	if m, found := mm[seq]; found {
+		if hm, err := imapclient.DecodeMailMessage(m, true); err == nil && len(hm) > 0 {
+			inHeader = parseTagsHeader(pickupTextPartMessage(hm).Header.Get(tagsHeader))
+		}
+	}
+	kws, err := keywordTags(c, seqStr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch flags: %v", err)
+	}
+	keywords := kws[seq]
+
+	var addHeader, removeHeader []string
+	for _, t := range remove {
+		if containsString(keywords, t) {
+			logTrace("imap", "cmd", "STORE -FLAGS", "seqset", seqStr, "keyword", t)
+			if err := c.Store(seqStr, "-FLAGS", []string{t}); err != nil {
+				return nil, fmt.Errorf("failed to remove %q from %q: %v", t, subject, err)
+			}
+			keywords = mergeTags(keywords, nil, []string{t})
+		}
+		if containsString(inHeader, t) {
+			removeHeader = append(removeHeader, t)
+		}
+	}
+	for _, t := range add {
+		if containsString(keywords, t) || containsString(inHeader, t) {
+			continue
+		}
+		if storage == tagStorageKeyword && isKeyword(t) {
+			logTrace("imap", "cmd", "STORE +FLAGS", "seqset", seqStr, "keyword", t)
+			err := c.Store(seqStr, "+FLAGS", []string{t})
+			if err == nil {
+				keywords = mergeTags(keywords, []string{t}, nil)
+				continue
+			}
+			logWarn("keyword refused", "tag", t, "err", err)
+			fmt.Fprintf(os.Stderr, "%v: the server refused a keyword (%v), stored in %v instead\n", t, err, tagsHeader)
+		}
+		addHeader = append(addHeader, t)
+	}
+
+	if len(addHeader) > 0 || len(removeHeader) > 0 {
+		inHeader = mergeTags(inHeader, addHeader, removeHeader)
+		if err := replaceTagsHeader(c, box, subject, seq, inHeader, keywords); err != nil {
+			return nil, err
+		}
+	}
+
+	return mergeTags(keywords, inHeader, nil), nil
+}
+
+// replaceTagsHeader replaces the message seq with the one having tags in tagsHeader.
+// Its flags and keywords are kept.
+func replaceTagsHeader(c *imapConn, box, subject string, seq uint32, tags, keywords []string) error {
+	seqStr := strconv.FormatUint(uint64(seq), 10)
+
+	mm, err := c.Fetch(seqStr)
+	if err != nil {
+		return err
+	}
+	raw, found := mm[seq]
+	if !found {
+		return fmt.Errorf("failed to fetch %q", subject)
+	}
+	if len(tags) > 0 {
+		raw.Header[tagsHeader] = []string{formatTagsHeader(tags)}
+	} else {
+		delete(raw.Header, tagsHeader)
+	}
+
+	flags, err := fetchFlags(c, seqStr)
+	if err != nil {
+		return fmt.Errorf("failed to fetch flags: %v", err)
+	}
+
+	expungeMu.Lock()
+	defer expungeMu.Unlock()
+
+	return critical(func() error {
+		// append first not to lose the message
+		logTrace("imap", "cmd", "APPEND", "box", box, "subject", subject)
+		if err := c.Append(box, append(flags[seq], keywords...), *raw); err != nil {
+			return fmt.Errorf("message append error of %q: %v", subject, err)
+		}
+		if err := c.Store(seqStr, "+FLAGS", []string{imapclient.FlagDeleted}); err != nil {
+			return fmt.Errorf("flag set error of %q: %v", subject, err)
+		}
+		if err := c.Expunge(); err != nil {
+			return fmt.Errorf("delete error of %q: %v", subject, err)
+		}
+		return nil
+	})
+}
+
+// carriedKeywords returns the keywords on the newest of found, to be set on the message replacing it.
+func carriedKeywords(c *imapConn, found []foundMessage) []string {
+	if len(found) == 0 {
+		return nil
+	}
+	seq := found[len(found)-1].Seq
+	kws, err := keywordTags(c, strconv.FormatUint(uint64(seq), 10))
+	if err != nil {
+		logDebug("keywords", "seq", seq, "err", err)
+		return nil
+	}
+	return kws[seq]
+}
+
+func containsString(ss []string, s string) bool {
+	for _, e := range ss {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
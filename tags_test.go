@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIsKeyword(t *testing.T) {
+	for tag, want := range map[string]bool{
+		"work":      true,
+		"to-do_1.x": true,
+		"":          false,
+		"two words": false,
+		"仕事":        false,
+		`\Seen`:     false,
+		"a*b":       false,
+		"a]":        false,
+	} {
+		if got := isKeyword(tag); got != want {
+			t.Errorf("isKeyword(%q) = %v", tag, got)
+		}
+	}
+
+	for _, tag := range []string{"", " ", "a,b", `\Flagged`, "$Junk"} {
+		if _, err := normalizeTag(tag); err == nil {
+			t.Errorf("normalizeTag(%q) must fail", tag)
+		}
+	}
+	if tag, err := normalizeTag(" 仕事 "); err != nil || tag != "仕事" {
+		t.Errorf("normalizeTag = %q, %v", tag, err)
+	}
+}
+
+func TestTagsHeader(t *testing.T) {
+	tags := mergeTags([]string{"b", "仕事"}, []string{"a", "b"}, []string{"c"})
+	if strings.Join(tags, ",") != "a,b,仕事" {
+		t.Fatalf("mergeTags = %q", tags)
+	}
+
+	v := formatTagsHeader(tags)
+	if strings.Contains(v, "仕事") {
+		t.Errorf("not encoded: %q", v)
+	}
+	if got := parseTagsHeader(v); strings.Join(got, ",") != "a,b,仕事" {
+		t.Errorf("parseTagsHeader(%q) = %q", v, got)
+	}
+	if got := parseTagsHeader(" x ,, y,x"); strings.Join(got, ",") != "x,y" {
+		t.Errorf("parseTagsHeader = %q", got)
+	}
+}
+
+func TestFlagTags(t *testing.T) {
+	got := flagTags([]string{`\Seen`, "work", "$Forwarded", `\Flagged`, "home", "work"})
+	if strings.Join(got, ",") != "home,work" {
+		t.Errorf("flagTags = %q", got)
+	}
+	if got := flagTags([]string{`\Seen`}); len(got) != 0 {
+		t.Errorf("flagTags = %q", got)
+	}
+}
+
+func TestChangeTagsOfParts(t *testing.T) {
+	part := func(seq, i int) string {
+		header := fmt.Sprintf("Subject: memo (%d/2)\r\nX-Pomi-Parent: memo\r\nX-Pomi-Part: %d/2\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n", i, i)
+		return fmt.Sprintf("* %d FETCH (UID %d FLAGS (\\Seen) BODY[HEADER] {%d}\r\n%v)", seq, seq+10, len(header), header)
+	}
+	fetchParts := []string{part(1, 1), part(2, 2), "TAG OK done"}
+
+	c := startFakeIMAP(t, time.Second, []fakeIMAPStep{
+		// no message with the very subject
+		{Command: `SEARCH SUBJECT "memo"`, Reply: []string{"* SEARCH 1 2", "TAG OK done"}},
+		{Command: "FETCH 1,2 (UID FLAGS BODY.PEEK[])", Reply: fetchParts},
+		// but parts
+		{Command: `SEARCH SUBJECT "memo"`, Reply: []string{"* SEARCH 1 2", "TAG OK done"}},
+		{Command: "FETCH 1,2 (UID FLAGS BODY.PEEK[HEADER])", Reply: fetchParts},
+
+		{Command: "FETCH 2 (UID FLAGS BODY.PEEK[HEADER])", Reply: []string{part(2, 2), "TAG OK done"}},
+		{Command: "FETCH 2 (FLAGS)", Reply: []string{`* 2 FETCH (FLAGS (\Seen home))`, "TAG OK done"}},
+		{Command: "STORE 2 +FLAGS (work)", Reply: []string{"TAG OK done"}},
+
+		{Command: "FETCH 1 (UID FLAGS BODY.PEEK[HEADER])", Reply: []string{part(1, 1), "TAG OK done"}},
+		{Command: "FETCH 1 (FLAGS)", Reply: []string{`* 1 FETCH (FLAGS (\Seen))`, "TAG OK done"}},
+		{Command: "STORE 1 +FLAGS (work)", Reply: []string{"TAG OK done"}},
+	})
+
+	tags, err := changeTags(c, "Notes", "memo", []string{"work"}, nil, tagStorageKeyword)
+	if err != nil || strings.Join(tags, ",") != "home,work" {
+		t.Errorf("changeTags = %q, %v", tags, err)
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"net/mail"
 	"os"
@@ -26,19 +27,19 @@ func getTestConfig() *config {
 	return c
 }
 
-func initTestIMAP(config *config) *imapclient.Client {
-	c, err := connIMAP(config)
+func initTestIMAP(config *config) *imapConn {
+	c, err := connIMAP(context.Background(), config)
 	if err != nil {
 		panic(err)
 	}
-	err = loginIMAP(c, config)
+	err = loginIMAP(context.Background(), c, config)
 	if err != nil {
 		panic(err)
 	}
 	return c
 }
 
-func getTestFixtures() (*config, *imapclient.Client) {
+func getTestFixtures() (*config, *imapConn) {
 	config := getTestConfig()
 	setAuthVariables(config)
 
@@ -47,7 +48,7 @@ func getTestFixtures() (*config, *imapclient.Client) {
 	return config, ic
 }
 
-func setupTestBox(t *testing.T, config *config, ic *imapclient.Client) {
+func setupTestBox(t *testing.T, config *config, ic *imapConn) {
 	ic.Delete(config.IMAP.Box)
 	if err := ic.Create(config.IMAP.Box); err != nil {
 		t.Errorf("failed to create box %q: %v", config.IMAP.Box, err)
@@ -58,7 +59,7 @@ func setupTestBox(t *testing.T, config *config, ic *imapclient.Client) {
 	}
 }
 
-func teardownTestBox(t *testing.T, config *config, ic *imapclient.Client) {
+func teardownTestBox(t *testing.T, config *config, ic *imapConn) {
 	if err := ic.Delete(config.IMAP.Box); err != nil {
 		t.Errorf("failed to delete box %q: %v", config.IMAP.Box, err)
 	}
@@ -93,7 +94,7 @@ func makeMailMessage(subject, body string, date time.Time) *mail.Message {
 	return msg
 }
 
-func msgsExistsExactly(t *testing.T, ic *imapclient.Client, subjects []string) {
+func msgsExistsExactly(t *testing.T, ic *imapConn, subjects []string) {
 	list, err := listMessages(ic, "", "")
 	if err != nil {
 		t.Errorf("failed to list msgs: %v", err)
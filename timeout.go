@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultDialTimeout    = 30  // seconds
+	defaultCommandTimeout = 120 // seconds
+	defaultHTTPTimeout    = 30  // seconds
+)
+
+// timeouts is [TIMEOUT] of the config with defaults filled.
+// Total is 0 if the whole run is not limited.
+type timeouts struct {
+	Dial    time.Duration
+	Command time.Duration
+	HTTP    time.Duration
+	Total   time.Duration
+}
+
+func (c *config) timeouts() timeouts {
+	seconds := func(n, def int) time.Duration {
+		if n <= 0 {
+			n = def
+		}
+		return time.Duration(n) * time.Second
+	}
+
+	t := timeouts{
+		Dial:    seconds(c.TIMEOUT.Dial, defaultDialTimeout),
+		Command: seconds(c.TIMEOUT.Command, defaultCommandTimeout),
+		HTTP:    seconds(c.TIMEOUT.HTTP, defaultHTTPTimeout),
+	}
+	if c.TIMEOUT.Total > 0 {
+		t.Total = time.Duration(c.TIMEOUT.Total) * time.Second
+	}
+	return t
+}
+
+func (c *config) httpClient() *http.Client {
+	return &http.Client{Timeout: c.timeouts().HTTP}
+}
+
+// timeoutError is returned when an IMAP command does not finish in time.
+// The connection has been closed, so nothing of the command goes on after it.
+type timeoutError struct {
+	name string
+	d    time.Duration
+}
+
+func (e *timeoutError) Error() string {
+	return fmt.Sprintf("%v: timed out after %v", e.name, e.d)
+}
+
+var (
+	// rootCtx is canceled on the first interrupt.
+	rootCtx, cancelRoot = context.WithCancel(context.Background())
+
+	// criticalMu is read-locked while a message is being replaced,
+	// and write-locked by an interrupt waiting for them to finish.
+	criticalMu sync.RWMutex
+
+	watchingMu sync.Mutex
+	watching   bool
+)
+
+// critical runs f to the end even if interrupted,
+// so that a message is not left half replaced.
+func critical(f func() error) error {
+	criticalMu.RLock()
+	defer criticalMu.RUnlock()
+
+	return f()
+}
+
+// handleInterrupt handles SIGINT for the whole run.
+//
+// The first one cancels rootCtx. A command using commandContext stops by itself after the current message;
+// otherwise the process exits as soon as no message is being replaced.
+// The second one exits immediately.
+func handleInterrupt() {
+	sigChan := make(chan os.Signal, 2)
+	signal.Notify(sigChan, os.Interrupt)
+
+	<-sigChan
+	cancelRoot()
+
+	watchingMu.Lock()
+	w := watching
+	watchingMu.Unlock()
+
+	if w {
+		fmt.Fprintf(os.Stderr, "\ninterrupted. finishing the current messages (press Ctrl-C again to abort)\n")
+	} else {
+		go func() {
+			criticalMu.Lock()
+			fmt.Fprintf(os.Stderr, "\ninterrupted\n")
+			os.Exit(130)
+		}()
+	}
+
+	<-sigChan
+	fmt.Fprintf(os.Stderr, "\naborted\n")
+	os.Exit(130)
+}
+
+// commandContext returns a context for a bulk operation, which is done on an interrupt or after [TIMEOUT] Total.
+// The caller is responsible to stop at a safe point when it is done.
+func commandContext(config *config) (context.Context, context.CancelFunc) {
+	watchingMu.Lock()
+	watching = true
+	watchingMu.Unlock()
+
+	if total := config.timeouts().Total; total > 0 {
+		return context.WithTimeout(rootCtx, total)
+	}
+	return context.WithCancel(rootCtx)
+}
+
+// postForm is http.PostForm with ctx and client.
+func postForm(ctx context.Context, client *http.Client, target string, form url.Values) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", target, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return client.Do(req)
+}
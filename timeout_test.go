@@ -0,0 +1,23 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCommandTimeout(t *testing.T) {
+	c := startFakeIMAP(t, 50*time.Millisecond, []fakeIMAPStep{
+		{Command: "NOOP"},
+	})
+
+	_, err := c.execute("NOOP")
+	if err == nil || !strings.Contains(err.Error(), "timed out") || !isTransient(err) {
+		t.Fatalf("err = %v", err)
+	}
+
+	start := time.Now()
+	if _, err := c.execute("NOOP"); err == nil || time.Since(start) > 10*time.Millisecond {
+		t.Errorf("a broken connection must fail at once: %v", err)
+	}
+}